@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"time"
+
+	"github.com/sloweax/sockx/proxy"
+	"github.com/sloweax/sockx/proxy/http"
+	"github.com/sloweax/sockx/proxy/socks4"
+	"github.com/sloweax/sockx/proxy/socks5"
+)
+
+var ErrRejected = errors.New("connection rejected by rule")
+
+type Handler struct {
+	config *proxy.Config
+	retry  uint
+	// number of chains dialed at once, 0 or 1 disables racing
+	race      uint
+	raceDelay time.Duration
+	// whether clients are required to authenticate
+	auth bool
+}
+
+func (h *Handler) Mixed(conn net.Conn, s4 *socks4.Server, s5 *socks5.Server, hs *http.Server) {
+	version, conn, err := Peek(conn)
+	if err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	switch version {
+	case socks4.Version:
+		h.SOCKS4(s4, conn)
+	case socks5.Version:
+		h.SOCKS5(s5, conn)
+	default:
+		h.HTTP(hs, conn)
+	}
+}
+
+func (h *Handler) SOCKS4(server *socks4.Server, conn net.Conn) {
+	req, err := server.Handle(conn)
+	if err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	// socks4 has no means of authenticating clients
+	if h.auth {
+		server.Reply(conn, socks4.ReplyRejected, req.Addr)
+		log.Print(fmt.Errorf("server: rejected socks4 request from %s, authentication is required", conn.RemoteAddr()))
+		return
+	}
+
+	// the userid is not authenticated, so it is not used for routing
+	rconn, d, err := h.connect(newSession(conn, "", req.Addr.String()))
+	if err != nil {
+		server.Reply(conn, socks4.ReplyRejected, req.Addr)
+		return
+	}
+	defer rconn.Close()
+
+	if err := server.Reply(conn, socks4.ReplyOK, req.Addr); err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	log.Printf("connection from %s to %s (%s)", conn.RemoteAddr(), req.Addr.String(), d.String())
+
+	defer h.track(d)()
+
+	if err := Bridge(conn, rconn); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *Handler) SOCKS5(server *socks5.Server, conn net.Conn) {
+	req, err := server.Handle(conn)
+	if err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	bnd, _ := socks5.NewAddress(conn.LocalAddr().String())
+
+	switch req.Cmd {
+	case socks5.CmdConnect:
+		rconn, d, err := h.connect(newSession(conn, req.Username, req.Addr.String()))
+		if err != nil {
+			server.Reply(conn, socks5Reply(err), bnd)
+			return
+		}
+		defer rconn.Close()
+
+		if err := server.Reply(conn, socks5.ReplyOK, bnd); err != nil {
+			log.Print(fmt.Errorf("server: %w", err))
+			return
+		}
+
+		log.Printf("connection from %s to %s (%s)", conn.RemoteAddr(), req.Addr.String(), d.String())
+
+		defer h.track(d)()
+
+		if err := Bridge(conn, rconn); err != nil {
+			log.Print(err)
+		}
+	case socks5.CmdBind:
+		s := newSession(conn, req.Username, req.Addr.String())
+		s.Filter = proxy.Chain.Bind
+		c, d, err := h.try(s, func(ctx context.Context, d *proxy.Dialer) (io.Closer, error) {
+			return d.BindContext(ctx, "tcp", req.Addr.String())
+		})
+		if err != nil {
+			server.Reply(conn, socks5Reply(err), bnd)
+			return
+		}
+		bconn := c.(proxy.BindConn)
+		defer bconn.Close()
+
+		listening, _ := socks5.NewAddress(bconn.BoundAddr().String())
+		if err := server.Reply(conn, socks5.ReplyOK, listening); err != nil {
+			log.Print(fmt.Errorf("server: %w", err))
+			return
+		}
+
+		peer, err := bconn.Accept()
+		if err != nil {
+			log.Print(err)
+			server.Reply(conn, socks5.ReplyGeneralFailure, listening)
+			return
+		}
+
+		paddr, _ := socks5.NewAddress(peer.String())
+		if err := server.Reply(conn, socks5.ReplyOK, paddr); err != nil {
+			log.Print(fmt.Errorf("server: %w", err))
+			return
+		}
+
+		log.Printf("bind from %s accepted %s (%s)", conn.RemoteAddr(), peer.String(), d.String())
+
+		defer h.track(d)()
+
+		if err := Bridge(conn, bconn); err != nil {
+			log.Print(err)
+		}
+	case socks5.CmdUDPAssociate:
+		// datagrams may have any destination, so only user rules apply
+		s := newSession(conn, req.Username, "")
+		s.Filter = proxy.Chain.UDP
+		c, d, err := h.try(s, func(ctx context.Context, d *proxy.Dialer) (io.Closer, error) {
+			return d.ListenPacket(ctx)
+		})
+		if err != nil {
+			server.Reply(conn, socks5.ReplyGeneralFailure, bnd)
+			return
+		}
+		pc := c.(net.PacketConn)
+
+		log.Printf("udp association from %s (%s)", conn.RemoteAddr(), d.String())
+
+		defer h.track(d)()
+
+		// rejected destinations are still enforced for each datagram
+		pc = h.config.FilterPacketConn(pc, req.Username)
+
+		if err := server.UDPAssociate(conn, pc); err != nil {
+			log.Print(fmt.Errorf("server: %w", err))
+		}
+	}
+}
+
+func (h *Handler) HTTP(server *http.Server, conn net.Conn) {
+	conn, req, err := server.Handle(conn)
+	if err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	rconn, d, err := h.connect(newSession(conn, req.Username, req.Addr))
+	if errors.Is(err, ErrRejected) {
+		server.Reply(conn, nethttp.StatusForbidden)
+		return
+	} else if err != nil {
+		server.Reply(conn, nethttp.StatusBadGateway)
+		return
+	}
+	defer rconn.Close()
+
+	if req.HTTP == nil {
+		err = server.Reply(conn, nethttp.StatusOK)
+	} else {
+		err = server.Forward(rconn, req)
+	}
+	if err != nil {
+		log.Print(fmt.Errorf("server: %w", err))
+		return
+	}
+
+	log.Printf("connection from %s to %s (%s)", conn.RemoteAddr(), req.Addr, d.String())
+
+	defer h.track(d)()
+
+	if err := Bridge(conn, rconn); err != nil {
+		log.Print(err)
+	}
+}
+
+// dials through d, returning the connection or listener to be used
+type dialFunc func(ctx context.Context, d *proxy.Dialer) (io.Closer, error)
+
+func (h *Handler) connect(s *proxy.Session) (net.Conn, *proxy.Dialer, error) {
+	c, d, err := h.try(s, func(ctx context.Context, d *proxy.Dialer) (io.Closer, error) {
+		return d.DialContext(ctx, "tcp", s.Address)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(net.Conn), d, nil
+}
+
+// calls fn with chains from the picker chosen by routing rules until it
+// succeeds or retries are exhausted. s.User and s.Address may be empty
+func (h *Handler) try(s *proxy.Session, fn dialFunc) (io.Closer, *proxy.Dialer, error) {
+	target, picker := h.config.Route(s.User, s.Address)
+
+	switch target {
+	case proxy.TargetReject:
+		log.Printf("rejected connection to %s", s.Address)
+		return nil, nil, ErrRejected
+	case proxy.TargetDirect:
+		d := proxy.New()
+		c, err := fn(context.Background(), d)
+		if err != nil {
+			log.Print(err)
+			return nil, nil, err
+		}
+		return c, d, nil
+	}
+
+	if picker == nil || picker.Len() == 0 {
+		err := fmt.Errorf("no chains to reach %s (%s)", s.Address, target)
+		log.Print(err)
+		return nil, nil, err
+	}
+
+	if h.race > 1 {
+		return h.racing(s, picker, fn)
+	}
+
+	var err error
+
+	for i := uint(0); i <= h.retry; i++ {
+		chain := h.next(picker, s)
+		if chain == nil {
+			// every chain failed
+			break
+		}
+
+		var (
+			c io.Closer
+			d *proxy.Dialer
+		)
+
+		c, d, err = h.attempt(context.Background(), chain, fn)
+		if err != nil {
+			s.Failed = append(s.Failed, chain)
+			continue
+		}
+
+		return c, d, nil
+	}
+
+	if err == nil {
+		// the picker was emptied by a reload, or every chain was skipped
+		err = fmt.Errorf("no available chains to reach %s", s.Address)
+		log.Print(err)
+	}
+
+	return nil, nil, err
+}
+
+// calls fn with up to h.race chains at once, starting one every h.raceDelay
+// or as soon as another one fails, and keeps the first one that succeeds.
+// the others are cancelled. up to h.retry failed chains are replaced
+func (h *Handler) racing(s *proxy.Session, picker proxy.ChainPicker, fn dialFunc) (io.Closer, *proxy.Dialer, error) {
+	type result struct {
+		chain proxy.Chain
+		c     io.Closer
+		d     *proxy.Dialer
+		err   error
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan result)
+
+	// chains being dialed are not picked again
+	tried := *s
+	tried.Failed = append([]proxy.Chain{}, s.Failed...)
+
+	var (
+		err     error
+		wait    <-chan time.Time
+		started uint
+		running uint
+	)
+
+	limit := h.race + h.retry
+
+	for {
+		if wait == nil && started < limit && running < h.race {
+			if chain := h.next(picker, &tried); chain != nil {
+				tried.Failed = append(tried.Failed, chain)
+				started++
+				running++
+				wait = time.After(h.raceDelay)
+				go func() {
+					c, d, err := h.attempt(ctx, chain, fn)
+					results <- result{chain, c, d, err}
+				}()
+			} else {
+				limit = started
+			}
+		}
+
+		if running == 0 {
+			if err == nil {
+				// the picker was emptied by a reload, or every chain was skipped
+				err = fmt.Errorf("no available chains to reach %s", s.Address)
+				log.Print(err)
+			}
+			return nil, nil, err
+		}
+
+		select {
+		case <-wait:
+			wait = nil
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// chains that succeed after the winner are closed
+				go func(n uint) {
+					for ; n > 0; n-- {
+						if r := <-results; r.err == nil {
+							r.c.Close()
+						}
+					}
+				}(running)
+				return r.c, r.d, nil
+			}
+			err = r.err
+			s.Failed = append(s.Failed, r.chain)
+			wait = nil
+		}
+	}
+}
+
+// picks a chain, claiming the connection let through its circuit breaker if
+// it is half-open. chains whose connection was already claimed are skipped
+func (h *Handler) next(picker proxy.ChainPicker, s *proxy.Session) proxy.Chain {
+	n := len(s.Failed)
+	defer func() { s.Failed = s.Failed[:n] }()
+
+	for {
+		chain := picker.Next(s)
+		if chain == nil || h.config.Monitor.Attempt(chain) {
+			return chain
+		}
+		s.Failed = append(s.Failed, chain)
+	}
+}
+
+// calls fn with chain, which must come from h.next, recording the result in
+// the monitor. failures caused by cancelling ctx or by chains unable to make
+// the connection are not recorded
+func (h *Handler) attempt(ctx context.Context, chain proxy.Chain, fn dialFunc) (io.Closer, *proxy.Dialer, error) {
+	d, err := chain.ToDialer()
+	if err != nil {
+		h.config.Monitor.Aborted(chain)
+		err = fmt.Errorf("server: %w", err)
+		log.Print(err)
+		return nil, nil, err
+	}
+
+	cctx, cancel, err := chainCtx(ctx, chain)
+	if err != nil {
+		h.config.Monitor.Aborted(chain)
+		log.Print(err)
+		return nil, nil, err
+	}
+	defer cancel()
+
+	start := time.Now()
+	c, err := fn(cctx, d)
+	if err != nil {
+		if ctx.Err() != nil {
+			h.config.Monitor.Aborted(chain)
+			return nil, nil, err
+		}
+		if errors.Is(err, proxy.ErrUnsupported) {
+			h.config.Monitor.Aborted(chain)
+			log.Print(err)
+			return nil, nil, err
+		}
+		log.Print(err)
+		h.config.Monitor.Stats(chain).ObserveFailure()
+		if h.config.Monitor.Failed(chain) {
+			log.Printf("circuit breaker: %s is open", chain.String())
+		}
+		return nil, nil, err
+	}
+
+	h.config.Monitor.Stats(chain).Observe(time.Since(start))
+	if h.config.Monitor.Succeeded(chain) {
+		log.Printf("circuit breaker: %s is closed", chain.String())
+	}
+
+	return c, d, nil
+}
+
+func newSession(conn net.Conn, user, address string) *proxy.Session {
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		// unix sockets have no client address
+		client = ""
+	}
+	return &proxy.Session{Client: client, User: user, Address: address}
+}
+
+// counts a connection as open on the chain of d until the returned
+// function is called
+func (h *Handler) track(d *proxy.Dialer) func() {
+	chain := d.Chain()
+	if chain == nil {
+		return func() {}
+	}
+	stats := h.config.Monitor.Stats(chain)
+	stats.ConnOpened()
+	return stats.ConnClosed
+}
+
+func socks5Reply(err error) socks5.Reply {
+	if errors.Is(err, ErrRejected) {
+		return socks5.ReplyConnNotAllowed
+	}
+	return socks5.ReplyGeneralFailure
+}
+
+func chainCtx(parent context.Context, chain proxy.Chain) (context.Context, context.CancelFunc, error) {
+	timeoutstr, ok := chain[0].KWArgs["ChainConnTimeout"]
+	if !ok {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, nil
+	}
+
+	duration, err := time.ParseDuration(timeoutstr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(parent, duration)
+	return ctx, cancel, nil
+}
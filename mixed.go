@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+)
+
+// accepts socks4, socks5 and http clients on the same address
+type MixedServer struct {
+	mutex    sync.RWMutex
+	closed   bool
+	listener net.Listener
+}
+
+// conn with data that was peeked from it
+type PeekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewMixedServer() *MixedServer {
+	s := new(MixedServer)
+	s.closed = true
+	return s
+}
+
+func (s *MixedServer) Listen(network, address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		return errors.New("server is already listening")
+	}
+	var err error
+	s.closed = false
+	s.listener, err = net.Listen(network, address)
+	return err
+}
+
+func (s *MixedServer) Accept() (net.Conn, error) {
+	if s.Closed() {
+		return nil, errors.New("server is closed")
+	}
+	return s.listener.Accept()
+}
+
+func (s *MixedServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errors.New("server is already closed")
+	}
+	s.closed = true
+	return s.listener.Close()
+}
+
+func (s *MixedServer) Closed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.closed
+}
+
+// returns the first byte sent by the client and a conn that still holds it
+func Peek(conn net.Conn) (byte, net.Conn, error) {
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, nil, err
+	}
+	return b[0], &PeekedConn{Conn: conn, r: r}, nil
+}
+
+func (c *PeekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
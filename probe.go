@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sloweax/sockx/proxy"
+)
+
+type TestConfig struct {
+	Jobs        uint     `name:"j" alias:"jobs" metavar:"num" description:"test up to num chains at once (default: 16)"`
+	Timeout     string   `name:"t" alias:"timeout" metavar:"duration" description:"time a chain has to reach target (default: 10s)"`
+	Target      string   `type:"positional" required:"true" name:"target" metavar:"target" description:"addr:port to connect to, or http(s) url to fetch. the response body is shown as the exit ip if it is one"`
+	ConfigFiles []string `type:"positional" name:"file" metavar:"file..." description:"load config from file"`
+}
+
+type probeResult struct {
+	chain proxy.Chain
+	// time taken by each hop, only hops that were established are set
+	hops []time.Duration
+	// ip returned by http targets, empty if none
+	exit string
+	err  error
+}
+
+// connects to target through every loaded chain and prints the results.
+// returns the exit code, which is 1 if any chain failed
+func probe(config *Config) int {
+	config.ConfigFiles = append(config.ConfigFiles, config.Test.ConfigFiles...)
+
+	if readsStdin(config) {
+		fmt.Fprintln(os.Stderr, "no specified config files, reading from stdin")
+	}
+
+	timeout, err := time.ParseDuration(config.Test.Timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Errorf("timeout: %w", err))
+		return 1
+	}
+
+	pconfig, err := load(config, proxy.NewMonitor())
+	if err != nil {
+		if errs, ok := err.(proxy.ConfigErrors); ok {
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
+	chains := pconfig.Picker.All()
+
+	names := make([]string, 0, len(pconfig.Groups))
+	for name := range pconfig.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		chains = append(chains, pconfig.Groups[name].All()...)
+	}
+
+	jobs := config.Test.Jobs
+	if jobs == 0 {
+		jobs = 1
+	}
+
+	results := make([]probeResult, len(chains))
+	sem := make(chan struct{}, jobs)
+	wg := sync.WaitGroup{}
+
+	for i, chain := range chains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chain proxy.Chain) {
+			defer wg.Done()
+			results[i] = probeChain(chain, config.Test.Target, timeout)
+			<-sem
+		}(i, chain)
+	}
+
+	wg.Wait()
+
+	code := 0
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHAIN\tSTATUS\tHOPS\tEXIT\tERROR")
+
+	for _, r := range results {
+		status := "ok"
+		if r.err != nil {
+			status = "failed"
+			code = 1
+		}
+
+		hops := make([]string, len(r.chain))
+		for i := range hops {
+			if i < len(r.hops) {
+				hops[i] = r.hops[i].Round(time.Millisecond).String()
+			} else {
+				hops[i] = "-"
+			}
+		}
+
+		exit := r.exit
+		if len(exit) == 0 {
+			exit = "-"
+		}
+
+		errstr := "-"
+		if r.err != nil {
+			errstr = r.err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.chain.String(), status, strings.Join(hops, " "), exit, errstr)
+	}
+
+	w.Flush()
+
+	return code
+}
+
+func probeChain(chain proxy.Chain, target string, timeout time.Duration) probeResult {
+	r := probeResult{chain: chain}
+
+	d, err := chain.ToDialer()
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cctx, ccancel, err := chainCtx(ctx, chain)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer ccancel()
+
+	// hops may still be traced after an http request is cancelled
+	mutex := sync.Mutex{}
+	hops := make([]time.Duration, 0, len(chain))
+	cctx = proxy.WithTrace(cctx, func(hop int, elapsed time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		hops = append(hops, elapsed)
+	})
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		r.exit, r.err = fetch(cctx, d, target)
+	} else {
+		var conn net.Conn
+		conn, r.err = d.DialContext(cctx, "tcp", target)
+		if r.err == nil {
+			conn.Close()
+		}
+	}
+
+	mutex.Lock()
+	r.hops = append(r.hops, hops...)
+	mutex.Unlock()
+
+	return r
+}
+
+// fetches url through d, returning the ip in the first line of the response
+// body, or an empty string if it is not one
+func fetch(ctx context.Context, d *proxy.Dialer, url string) (string, error) {
+	transport := &nethttp.Transport{
+		DialContext:       d.DialContext,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := (&nethttp.Client{Transport: transport}).Do(req)
+	if err != nil {
+		// the url is already known, only keep the cause
+		if uerr, ok := err.(*neturl.Error); ok {
+			err = uerr.Err
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != nethttp.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(string(body)), "\n")
+	ip := net.ParseIP(strings.TrimSpace(line))
+	if ip == nil {
+		return "", nil
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// reads `username password` pairs (one per line) into users
+func LoadCredentials(users map[string]string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := parseFields(line)
+		if err != nil {
+			return fmt.Errorf("credentials: line %d: %w", lineno, err)
+		}
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			users[fields[0]] = fields[1]
+		default:
+			return fmt.Errorf("credentials: line %d: expected `username password`, got `%s`", lineno, line)
+		}
+	}
+
+	return scanner.Err()
+}
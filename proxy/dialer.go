@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -9,8 +10,17 @@ import (
 	"time"
 )
 
+// returned when a chain is unable to make a kind of connection, which does
+// not mean the chain is failing
+var ErrUnsupported = errors.New("not supported")
+
 type Dialer struct {
 	proxies []ProxyDialer
+	// chain the dialer was created from, if any
+	chain Chain
+	// tls config of each proxy, nil if disabled. built when the dialer is
+	// created from a chain, otherwise on every dial
+	tls []*tls.Config
 }
 
 func New(proxies ...ProxyDialer) *Dialer {
@@ -19,7 +29,14 @@ func New(proxies ...ProxyDialer) *Dialer {
 	return d
 }
 
+func (d *Dialer) Chain() Chain {
+	return d.chain
+}
+
 func (d *Dialer) String() string {
+	if len(d.proxies) == 0 {
+		return "direct"
+	}
 	a := make([]string, 0, len(d.proxies))
 	for _, p := range d.proxies {
 		a = append(a, fmt.Sprintf("%s %s", p.Protocol(), p.String()))
@@ -28,10 +45,59 @@ func (d *Dialer) String() string {
 }
 
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address, ProxyDialer.DialContextWithConn)
+}
+
+// connects to the last proxy of the chain and asks it to accept an
+// inbound connection from address
+func (d *Dialer) BindContext(ctx context.Context, network, address string) (BindConn, error) {
 	if len(d.proxies) == 0 {
-		return nil, errors.New("no dialers")
+		return nil, fmt.Errorf("bind without a proxy is %w", ErrUnsupported)
 	}
 
+	p := d.proxies[len(d.proxies)-1]
+	if _, ok := p.(BindProxyDialer); !ok {
+		return nil, fmt.Errorf("%s %s: bind is %w", p.Protocol(), p.String(), ErrUnsupported)
+	}
+
+	conn, err := d.dial(ctx, network, address, func(p ProxyDialer, ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+		return p.(BindProxyDialer).BindContextWithConn(ctx, conn, network, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bconn, ok := conn.(BindConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%s %s: bind is %w", p.Protocol(), p.String(), ErrUnsupported)
+	}
+
+	return bconn, nil
+}
+
+// called by dialers after each hop of the chain is established, with the time
+// it took to connect to the hop and complete its handshake
+type HopTrace func(hop int, elapsed time.Duration)
+
+type traceKey struct{}
+
+// returns a context that makes dialers call trace
+func WithTrace(ctx context.Context, trace HopTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+type lastHopFunc func(p ProxyDialer, ctx context.Context, conn net.Conn, network, address string) (net.Conn, error)
+
+// a dialer without proxies connects directly to address
+func (d *Dialer) dial(ctx context.Context, network, address string, last lastHopFunc) (net.Conn, error) {
+	if len(d.proxies) == 0 {
+		dialer := net.Dialer{}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	trace, _ := ctx.Value(traceKey{}).(HopTrace)
+
 	p := d.proxies[0]
 	entryctx, cancel, err := proxyCtx(p, ctx)
 	if err != nil {
@@ -39,6 +105,8 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	}
 	defer cancel()
 
+	start := time.Now()
+
 	dialer := net.Dialer{}
 	conn, err := dialer.DialContext(entryctx, p.Network(), p.String())
 	if err != nil {
@@ -75,12 +143,37 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		}
 		defer pcancel()
 
-		pconn, err := p.DialContextWithConn(pctx, conn, pnetwork, paddress)
+		tlsconfig, err := d.tlsConfig(i)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		}
+
+		if tlsconfig != nil {
+			tconn := tls.Client(conn, tlsconfig)
+			if err := tconn.HandshakeContext(pctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			}
+			conn = tconn
+		}
+
+		var pconn net.Conn
+		if i == len(d.proxies)-1 {
+			pconn, err = last(p, pctx, conn, pnetwork, paddress)
+		} else {
+			pconn, err = p.DialContextWithConn(pctx, conn, pnetwork, paddress)
+		}
 		if err != nil {
 			conn.Close()
 			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
 		}
 		conn = pconn
+
+		if trace != nil {
+			trace(i, time.Since(start))
+		}
+		start = time.Now()
 	}
 
 	p = d.proxies[len(d.proxies)-1]
@@ -103,6 +196,72 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	return conn, nil
 }
 
+// only single proxy chains are able to carry udp, since datagrams are
+// sent directly to the proxy
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if len(d.proxies) == 0 {
+		pc, err := net.ListenPacket("udp", "")
+		if err != nil {
+			return nil, err
+		}
+		return &directPacketConn{pc}, nil
+	}
+
+	if len(d.proxies) != 1 {
+		return nil, fmt.Errorf("udp through more than one proxy is %w", ErrUnsupported)
+	}
+
+	p, ok := d.proxies[0].(PacketProxyDialer)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: udp is %w", d.proxies[0].Protocol(), d.proxies[0].String(), ErrUnsupported)
+	}
+
+	// the udp association would be negotiated in cleartext
+	if tlsconfig, err := d.tlsConfig(0); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	} else if tlsconfig != nil {
+		return nil, fmt.Errorf("%s %s: udp over tls is %w", p.Protocol(), p.String(), ErrUnsupported)
+	}
+
+	pctx, cancel, err := proxyCtx(p, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+	defer cancel()
+
+	pc, err := p.ListenPacketContext(pctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+
+	return pc, nil
+}
+
+// udp conn that resolves destinations, since datagrams relayed from clients
+// are addressed with socks5.Addr and may hold domain names
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		uaddr, err = net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(b, uaddr)
+}
+
+func (d *Dialer) tlsConfig(i int) (*tls.Config, error) {
+	if d.tls != nil {
+		return d.tls[i], nil
+	}
+	return tlsConfig(d.proxies[i])
+}
+
 func setTimeoutStr(conn net.Conn, s string, fc func(time.Time) error) error {
 	d, err := time.ParseDuration(s)
 	if err != nil {
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// error found while loading a config
+type ConfigError struct {
+	// empty if the config was not read from a file
+	File string
+	Line int
+	// 1-based byte offset of Token in the line, 0 if unknown
+	Column int
+	Token  string
+	Err    error
+}
+
+// every error found while loading a config
+type ConfigErrors []*ConfigError
+
+func (e *ConfigError) Error() string {
+	s := "config: "
+	if len(e.File) != 0 {
+		s += e.File + ":"
+	}
+	s += fmt.Sprint(e.Line)
+	if e.Column != 0 {
+		s += fmt.Sprintf(":%d", e.Column)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (e ConfigErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// error caused by the field at index of a line
+type fieldError struct {
+	index int
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// error at the 0-based byte offset col of a line
+type syntaxError struct {
+	col   int
+	token string
+	err   error
+}
+
+func (e *syntaxError) Error() string {
+	return e.err.Error()
+}
+
+func (e *syntaxError) Unwrap() error {
+	return e.err
+}
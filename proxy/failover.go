@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// uses chains in config order, the first healthy chain that did not fail
+// for this session is picked
+type Failover struct {
+	mutex   sync.RWMutex
+	chains  []Chain
+	Monitor *Monitor
+}
+
+func (f *Failover) Add(c Chain) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.chains = append(f.chains, c)
+}
+
+// falls back to unhealthy chains in order
+func (f *Failover) Next(s *Session) Chain {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	var fallback Chain
+
+	for _, c := range f.chains {
+		if s.skips(c) {
+			continue
+		}
+		if f.Monitor.Healthy(c) {
+			return c
+		}
+		if fallback == nil {
+			fallback = c
+		}
+	}
+
+	return fallback
+}
+
+func (f *Failover) Replace(chains []Chain) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.chains = append([]Chain{}, chains...)
+}
+
+func (f *Failover) Len() int {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return len(f.chains)
+}
+
+func (f *Failover) All() []Chain {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(f.chains))
+	tmp = append(tmp, f.chains...)
+	return tmp
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// consistent hashing (rendezvous hashing) of a session key, so sessions with
+// the same key use the same chain while it stays healthy. when a chain is
+// added or becomes unhealthy, only the sessions that used it are moved.
+// sessions with an empty key use a random chain
+type Hash struct {
+	mutex   sync.RWMutex
+	chains  []Chain
+	Key     func(s *Session) string
+	Monitor *Monitor
+}
+
+func (h *Hash) Add(c Chain) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.chains = append(h.chains, c)
+}
+
+func (h *Hash) Next(s *Session) Chain {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	chains := h.Monitor.Available(h.chains, s)
+	if len(chains) == 0 {
+		return nil
+	}
+
+	key := ""
+	if s != nil {
+		key = h.Key(s)
+	}
+	if len(key) == 0 {
+		return chains[rand.Intn(len(chains))]
+	}
+
+	var (
+		best  Chain
+		score uint64
+	)
+
+	for _, c := range chains {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		// String is deterministic, unlike iterating KWArgs
+		hash.Write([]byte(c.String()))
+		if sum := hash.Sum64(); best == nil || sum > score {
+			best, score = c, sum
+		}
+	}
+
+	return best
+}
+
+func (h *Hash) Replace(chains []Chain) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.chains = append([]Chain{}, chains...)
+}
+
+func (h *Hash) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.chains)
+}
+
+func (h *Hash) All() []Chain {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(h.chains))
+	tmp = append(tmp, h.chains...)
+	return tmp
+}
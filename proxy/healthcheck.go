@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// max number of chains checked at the same time
+const healthCheckConcurrency = 32
+
+// periodically dials Target through every chain of the pickers
+type HealthCheck struct {
+	Monitor  *Monitor
+	Target   string
+	Interval time.Duration
+	Timeout  time.Duration
+	// consecutive successes needed to mark an unhealthy chain healthy
+	Rise int
+	// consecutive failures needed to mark a healthy chain unhealthy
+	Fall int
+	// called when a chain changes its health state, err is the last probe error
+	OnChange func(c Chain, healthy bool, err error)
+}
+
+// checks the pickers of c until ctx is done, following replacements of c
+func (h *HealthCheck) Run(ctx context.Context, c *Config) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.Check(ctx, c.Pickers()...)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checks every chain once
+func (h *HealthCheck) Check(ctx context.Context, pickers ...ChainPicker) {
+	sem := make(chan struct{}, healthCheckConcurrency)
+	wg := sync.WaitGroup{}
+
+	for _, picker := range pickers {
+		for _, chain := range picker.All() {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(chain Chain) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				err := h.probe(ctx, chain)
+				if h.Monitor.Stats(chain).Check(err == nil, h.Rise, h.Fall) && h.OnChange != nil {
+					h.OnChange(chain, err == nil, err)
+				}
+			}(chain)
+		}
+	}
+
+	wg.Wait()
+}
+
+func (h *HealthCheck) probe(ctx context.Context, chain Chain) error {
+	d, err := chain.ToDialer()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", h.Target)
+	if err != nil {
+		// not when the health check is stopped
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			h.Monitor.Stats(chain).ObserveFailure()
+		}
+		return err
+	}
+	h.Monitor.Stats(chain).Observe(time.Since(start))
+
+	return conn.Close()
+}
@@ -0,0 +1,16 @@
+package http
+
+import (
+	"bufio"
+	"net"
+)
+
+type Conn struct {
+	net.Conn
+	// may hold data sent by the remote right after the response
+	r *bufio.Reader
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
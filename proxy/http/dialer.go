@@ -0,0 +1,121 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type Config struct {
+	Username string
+	Password string
+}
+
+type Dialer struct {
+	address string
+	network string
+	config  Config
+	kwargs  map[string]string
+}
+
+func NewDialer(network, address string, kwargs map[string]string, config Config) *Dialer {
+	d := new(Dialer)
+	d.network = network
+	d.address = address
+	d.config = config
+	d.kwargs = kwargs
+	return d
+}
+
+func (d *Dialer) KWArgs() map[string]string {
+	return d.kwargs
+}
+
+func (d *Dialer) Protocol() string {
+	return "http"
+}
+
+func (d *Dialer) String() string {
+	return d.address
+}
+
+func (d *Dialer) Network() string {
+	return d.network
+}
+
+func (d *Dialer) request(conn net.Conn, address string) error {
+	buf := make([]byte, 0, 128)
+	buf = fmt.Appendf(buf, "CONNECT %s HTTP/1.1\r\n", address)
+	buf = fmt.Appendf(buf, "Host: %s\r\n", address)
+	if len(d.config.Username) != 0 || len(d.config.Password) != 0 {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.config.Username + ":" + d.config.Password))
+		buf = fmt.Appendf(buf, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	buf = append(buf, "\r\n"...)
+
+	_, err := conn.Write(buf)
+	return err
+}
+
+func (d *Dialer) response(r *bufio.Reader) error {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return err
+	}
+
+	// any 2xx status means the tunnel is open (RFC 9110 9.3.6)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return errors.New("invalid username/password")
+	default:
+		return fmt.Errorf("request rejected: %s", resp.Status)
+	}
+}
+
+func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("tcp only")
+	}
+
+	type result struct {
+		err  error
+		conn net.Conn
+	}
+
+	cresult := make(chan result, 1)
+
+	go func() {
+		defer close(cresult)
+		if err := d.request(conn, address); err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		r := bufio.NewReader(conn)
+		if err := d.response(r); err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		c := new(Conn)
+		c.Conn = conn
+		c.r = r
+		cresult <- result{conn: c}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	case result := <-cresult:
+		return result.conn, result.err
+	}
+}
@@ -0,0 +1,32 @@
+package http
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		status string
+		ok     bool
+	}{
+		{"200 Connection established", true},
+		{"200 OK", true},
+		{"204 No Content", true},
+		{"299 Whatever", true},
+		{"301 Moved Permanently", false},
+		{"403 Forbidden", false},
+		{"407 Proxy Authentication Required", false},
+		{"502 Bad Gateway", false},
+	}
+
+	d := &Dialer{}
+
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader("HTTP/1.1 " + test.status + "\r\n\r\n"))
+		if err := d.response(r); (err == nil) != test.ok {
+			t.Errorf("response(%q) = %v, want ok = %v", test.status, err, test.ok)
+		}
+	}
+}
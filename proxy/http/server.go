@@ -0,0 +1,173 @@
+package http
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	mutex    sync.RWMutex
+	closed   bool
+	listener net.Listener
+	config   ServerConfig
+}
+
+type ServerConfig struct {
+	// if not empty, clients are required to authenticate with username/password
+	Users map[string]string
+}
+
+type Request struct {
+	// host:port to connect to
+	Addr string
+	// authenticated username, empty if no authentication was required
+	Username string
+	// nil for CONNECT requests, otherwise the request that must be forwarded to Addr
+	HTTP *http.Request
+}
+
+func NewServer(config ServerConfig) *Server {
+	s := new(Server)
+	s.closed = true
+	s.config = config
+	return s
+}
+
+func (s *Server) Listen(network, address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		return errors.New("server is already listening")
+	}
+	var err error
+	s.closed = false
+	s.listener, err = net.Listen(network, address)
+	return err
+}
+
+func (s *Server) Accept() (net.Conn, error) {
+	if s.Closed() {
+		return nil, errors.New("server is closed")
+	}
+	return s.listener.Accept()
+}
+
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errors.New("server is already closed")
+	}
+	s.closed = true
+	return s.listener.Close()
+}
+
+func (s *Server) Closed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.closed
+}
+
+// reads and authenticates the client request. the returned conn must be
+// used instead of conn afterwards, replying to the request is left to the caller
+func (s *Server) Handle(conn net.Conn) (net.Conn, Request, error) {
+	r := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, Request{}, err
+	}
+
+	username, ok := s.authenticate(req)
+	if !ok {
+		s.Reply(conn, http.StatusProxyAuthRequired)
+		return nil, Request{}, errors.New("invalid username/password")
+	}
+
+	c := &Conn{Conn: conn, r: r}
+
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.RequestURI); err != nil {
+			s.Reply(conn, http.StatusBadRequest)
+			return nil, Request{}, err
+		}
+		return c, Request{Addr: req.RequestURI, Username: username}, nil
+	}
+
+	if req.URL.Scheme != "http" || len(req.URL.Host) == 0 {
+		s.Reply(conn, http.StatusBadRequest)
+		return nil, Request{}, fmt.Errorf("unsupported request uri %q", req.RequestURI)
+	}
+
+	addr := req.URL.Host
+	if len(req.URL.Port()) == 0 {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	// only a single request is forwarded per connection
+	req.Close = true
+
+	return c, Request{Addr: addr, Username: username, HTTP: req}, nil
+}
+
+// writes the request in origin-form to w
+func (s *Server) Forward(w io.Writer, req Request) error {
+	return req.HTTP.Write(w)
+}
+
+func (s *Server) Reply(w io.Writer, code int) error {
+	buf := make([]byte, 0, 128)
+	buf = fmt.Appendf(buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if code == http.StatusProxyAuthRequired {
+		buf = append(buf, "Proxy-Authenticate: Basic realm=\"sockx\"\r\n"...)
+	}
+	if code != http.StatusOK {
+		buf = append(buf, "Connection: close\r\nContent-Length: 0\r\n"...)
+	}
+	buf = append(buf, "\r\n"...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (s *Server) authenticate(req *http.Request) (string, bool) {
+	if len(s.config.Users) == 0 {
+		return "", true
+	}
+
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, credentials, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+
+	expected, ok := s.config.Users[username]
+	if !ok {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return "", false
+	}
+
+	return username, true
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// picks the chain with the lowest connect latency out of two random healthy
+// chains (power of two choices), so slow chains are still used occasionally
+// and their latency is kept up to date. chains that were never tried are
+// preferred, failed connections count as slow ones
+type Latency struct {
+	mutex   sync.RWMutex
+	chains  []Chain
+	Monitor *Monitor
+}
+
+func (l *Latency) Add(c Chain) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.chains = append(l.chains, c)
+}
+
+func (l *Latency) Next(s *Session) Chain {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	chains := l.Monitor.Available(l.chains, s)
+	if len(chains) == 0 {
+		return nil
+	}
+	if len(chains) == 1 {
+		return chains[0]
+	}
+
+	i := rand.Intn(len(chains))
+	j := rand.Intn(len(chains) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := chains[i], chains[j]
+	if l.Monitor.Latency(b) < l.Monitor.Latency(a) {
+		return b
+	}
+	return a
+}
+
+func (l *Latency) Replace(chains []Chain) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.chains = append([]Chain{}, chains...)
+}
+
+func (l *Latency) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.chains)
+}
+
+func (l *Latency) All() []Chain {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(l.chains))
+	tmp = append(tmp, l.chains...)
+	return tmp
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyFailed(t *testing.T) {
+	m := NewMonitor()
+	ok := Chain{{Protocol: "socks5", Address: "1.2.3.4:1080"}}
+	dead := Chain{{Protocol: "socks5", Address: "4.3.2.1:1080"}}
+
+	m.Stats(ok).Observe(500 * time.Millisecond)
+	m.Stats(dead).ObserveFailure()
+
+	l := &Latency{Monitor: m}
+	l.Add(ok)
+	l.Add(dead)
+
+	for i := 0; i < 100; i++ {
+		if c := l.Next(&Session{}); &c[0] != &ok[0] {
+			t.Fatalf("Next() = %s, want %s", c.String(), ok.String())
+		}
+	}
+}
+
+func TestLatencyUntried(t *testing.T) {
+	m := NewMonitor()
+	tried := Chain{{Protocol: "socks5", Address: "1.2.3.4:1080"}}
+	untried := Chain{{Protocol: "socks5", Address: "4.3.2.1:1080"}}
+
+	m.Stats(tried).Observe(time.Millisecond)
+
+	l := &Latency{Monitor: m}
+	l.Add(tried)
+	l.Add(untried)
+
+	for i := 0; i < 100; i++ {
+		if c := l.Next(&Session{}); &c[0] != &untried[0] {
+			t.Fatalf("Next() = %s, want %s", c.String(), untried.String())
+		}
+	}
+}
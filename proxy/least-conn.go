@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// picks the healthy chain with the least open connections. ties are
+// broken in round-robin order
+type LeastConn struct {
+	mutex   sync.RWMutex
+	index   int
+	chains  []Chain
+	Monitor *Monitor
+}
+
+func (l *LeastConn) Add(c Chain) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.chains = append(l.chains, c)
+}
+
+func (l *LeastConn) Next(s *Session) Chain {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	chains := l.Monitor.Available(l.chains, s)
+	if len(chains) == 0 {
+		return nil
+	}
+
+	var (
+		best  Chain
+		least int
+	)
+
+	for i := 0; i < len(chains); i++ {
+		chain := chains[(l.index+i)%len(chains)]
+		conns := l.Monitor.Conns(chain)
+		if best == nil || conns < least {
+			best = chain
+			least = conns
+		}
+	}
+
+	l.index += 1
+	return best
+}
+
+func (l *LeastConn) Replace(chains []Chain) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.chains = append([]Chain{}, chains...)
+}
+
+func (l *LeastConn) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.chains)
+}
+
+func (l *LeastConn) All() []Chain {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(l.chains))
+	tmp = append(tmp, l.chains...)
+	return tmp
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// weight of new latency samples
+const ewmaAlpha = 0.3
+
+// latency sample recorded for failed connections, so chains that fail are
+// not preferred over slow ones
+const failureLatency = 10 * time.Second
+
+// keeps runtime stats of chains, shared by pickers and whoever uses the
+// chains they return. a nil *Monitor considers every chain healthy
+type Monitor struct {
+	mutex sync.Mutex
+	stats map[*ProxyInfo]*Stats
+	// consecutive connection failures that open the circuit breaker of a
+	// chain, 0 disables it
+	Threshold int
+	// how long an open circuit breaker skips its chain before letting a
+	// single connection through to test it
+	Cooldown time.Duration
+}
+
+type Stats struct {
+	mutex     sync.Mutex
+	unhealthy bool
+	// consecutive health check results
+	successes int
+	failures  int
+	// exponentially weighted moving average of connect latency, 0 if no
+	// connection was attempted
+	latency float64
+	// number of open connections
+	conns int
+	// consecutive connection failures
+	errors int
+	// the circuit breaker is open until then, zero if closed. once it is
+	// reached the breaker is half-open
+	open time.Time
+	// whether a connection is being tried while half-open
+	trial bool
+}
+
+func NewMonitor() *Monitor {
+	m := new(Monitor)
+	m.stats = map[*ProxyInfo]*Stats{}
+	return m
+}
+
+// chains are identified by their first proxy, so copies of the same
+// Chain share stats
+func (m *Monitor) Stats(c Chain) *Stats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.stats[&c[0]]
+	if !ok {
+		s = new(Stats)
+		m.stats[&c[0]] = s
+	}
+	return s
+}
+
+// moves the stats of old chains to the chains that are equal to them,
+// dropping the rest. chains are compared by Chain.String, which does not
+// depend on the order of KWArgs. stats of a chain are moved at most once, so
+// duplicated chains never share them
+func (m *Monitor) Replace(old, chains []Chain) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := map[string][]*Stats{}
+	for _, c := range old {
+		if s, ok := m.stats[&c[0]]; ok {
+			key := c.String()
+			stats[key] = append(stats[key], s)
+		}
+	}
+
+	m.stats = map[*ProxyInfo]*Stats{}
+	for _, c := range chains {
+		key := c.String()
+		if s := stats[key]; len(s) != 0 {
+			m.stats[&c[0]] = s[0]
+			stats[key] = s[1:]
+		}
+	}
+}
+
+// whether c passes health checks and its circuit breaker is not open
+func (m *Monitor) Healthy(c Chain) bool {
+	if m == nil {
+		return true
+	}
+	s := m.Stats(c)
+	return s.Healthy() && s.Allowed()
+}
+
+// returns the healthy chains that s does not skip (see Session.Filter and
+// Session.Failed), or all of them if none is healthy. s may be nil
+func (m *Monitor) Available(chains []Chain, s *Session) []Chain {
+	r := make([]Chain, 0, len(chains))
+	for _, c := range chains {
+		if !s.skips(c) {
+			r = append(r, c)
+		}
+	}
+
+	if m == nil {
+		return r
+	}
+
+	healthy := make([]Chain, 0, len(r))
+	for _, c := range r {
+		if m.Healthy(c) {
+			healthy = append(healthy, c)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return r
+	}
+
+	return healthy
+}
+
+// must be called before connecting through c, so only one connection is
+// let through a half-open circuit breaker. returns false if that connection
+// was already claimed, in which case c must not be used
+func (m *Monitor) Attempt(c Chain) bool {
+	if m == nil {
+		return true
+	}
+	return m.Stats(c).Attempt()
+}
+
+// records a connection through c that was given up before it finished
+func (m *Monitor) Aborted(c Chain) {
+	if m == nil {
+		return
+	}
+	m.Stats(c).Aborted()
+}
+
+// records a successful connection through c. returns whether its circuit
+// breaker was closed
+func (m *Monitor) Succeeded(c Chain) bool {
+	if m == nil {
+		return false
+	}
+	return m.Stats(c).Succeeded()
+}
+
+// records a failed connection through c. returns whether its circuit breaker
+// was opened
+func (m *Monitor) Failed(c Chain) bool {
+	if m == nil {
+		return false
+	}
+	return m.Stats(c).Failed(m.Threshold, m.Cooldown)
+}
+
+// returns 0 if the latency of c is unknown
+func (m *Monitor) Latency(c Chain) time.Duration {
+	if m == nil {
+		return 0
+	}
+	return m.Stats(c).Latency()
+}
+
+func (s *Stats) Latency() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Duration(s.latency)
+}
+
+// records how long it took to connect through the chain
+func (s *Stats) Observe(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.latency == 0 {
+		s.latency = float64(d)
+	} else {
+		s.latency = ewmaAlpha*float64(d) + (1-ewmaAlpha)*s.latency
+	}
+}
+
+// records a failed connection attempt as a slow one
+func (s *Stats) ObserveFailure() {
+	s.Observe(failureLatency)
+}
+
+func (m *Monitor) Conns(c Chain) int {
+	if m == nil {
+		return 0
+	}
+	return m.Stats(c).Conns()
+}
+
+func (s *Stats) Conns() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conns
+}
+
+func (s *Stats) ConnOpened() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conns++
+}
+
+func (s *Stats) ConnClosed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conns--
+}
+
+func (s *Stats) Healthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.unhealthy
+}
+
+// records a health check result. a healthy chain is marked unhealthy after
+// fall consecutive failures and back to healthy after rise consecutive
+// successes. returns whether the health state changed
+func (s *Stats) Check(ok bool, rise, fall int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ok {
+		s.successes++
+		s.failures = 0
+		if s.unhealthy && s.successes >= rise {
+			s.unhealthy = false
+			return true
+		}
+	} else {
+		s.failures++
+		s.successes = 0
+		if !s.unhealthy && s.failures >= fall {
+			s.unhealthy = true
+			return true
+		}
+	}
+
+	return false
+}
+
+// whether the circuit breaker lets connections through
+func (s *Stats) Allowed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.open.IsZero() {
+		return true
+	}
+	if time.Now().Before(s.open) {
+		return false
+	}
+	return !s.trial
+}
+
+func (s *Stats) Attempt() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.open.IsZero() && !time.Now().Before(s.open) {
+		if s.trial {
+			return false
+		}
+		s.trial = true
+	}
+	return true
+}
+
+func (s *Stats) Aborted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trial = false
+}
+
+func (s *Stats) Succeeded() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	closed := !s.open.IsZero()
+	s.errors = 0
+	s.open = time.Time{}
+	s.trial = false
+	return closed
+}
+
+// the circuit breaker opens after threshold consecutive failures, or after
+// any failure while half-open. a threshold of 0 disables it
+func (s *Stats) Failed(threshold int, cooldown time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if threshold <= 0 {
+		return false
+	}
+
+	s.errors++
+
+	if !s.open.IsZero() {
+		// already open unless half-open
+		reopened := !time.Now().Before(s.open)
+		s.open = time.Now().Add(cooldown)
+		s.trial = false
+		return reopened
+	}
+
+	if s.errors >= threshold {
+		s.open = time.Now().Add(cooldown)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	const threshold = 3
+
+	type step struct {
+		// fail, succeed, abort, attempt or allowed
+		op string
+		// cooldown given to fail
+		cooldown time.Duration
+		// result of the op
+		want bool
+	}
+
+	// a zero cooldown makes an open breaker half-open right away
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"threshold opens", []step{
+			{"fail", time.Hour, false},
+			{"fail", time.Hour, false},
+			{"allowed", 0, true},
+			{"fail", time.Hour, true},
+			{"allowed", 0, false},
+		}},
+		{"success resets failures", []step{
+			{"fail", time.Hour, false},
+			{"fail", time.Hour, false},
+			{"succeed", 0, false},
+			{"fail", time.Hour, false},
+			{"allowed", 0, true},
+		}},
+		{"half-open lets one attempt through", []step{
+			{"fail", 0, false},
+			{"fail", 0, false},
+			{"fail", 0, true},
+			{"allowed", 0, true},
+			{"attempt", 0, true},
+			{"allowed", 0, false},
+			{"attempt", 0, false},
+			{"attempt", 0, false},
+		}},
+		{"success while half-open closes", []step{
+			{"fail", 0, false},
+			{"fail", 0, false},
+			{"fail", 0, true},
+			{"attempt", 0, true},
+			{"succeed", 0, true},
+			{"allowed", 0, true},
+			{"attempt", 0, true},
+			{"attempt", 0, true},
+		}},
+		{"failure while half-open reopens", []step{
+			{"fail", 0, false},
+			{"fail", 0, false},
+			{"fail", 0, true},
+			{"attempt", 0, true},
+			{"fail", time.Hour, true},
+			{"allowed", 0, false},
+			// already open
+			{"fail", time.Hour, false},
+		}},
+		{"abort releases the trial", []step{
+			{"fail", 0, false},
+			{"fail", 0, false},
+			{"fail", 0, true},
+			{"attempt", 0, true},
+			{"abort", 0, false},
+			{"allowed", 0, true},
+			{"attempt", 0, true},
+			{"attempt", 0, false},
+		}},
+	}
+
+	for _, test := range tests {
+		s := new(Stats)
+		for i, step := range test.steps {
+			var got bool
+			switch step.op {
+			case "fail":
+				got = s.Failed(threshold, step.cooldown)
+			case "succeed":
+				got = s.Succeeded()
+			case "abort":
+				s.Aborted()
+			case "attempt":
+				got = s.Attempt()
+			case "allowed":
+				got = s.Allowed()
+			}
+			if got != step.want {
+				t.Errorf("%s: step %d (%s) = %v, want %v", test.name, i, step.op, got, step.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	s := new(Stats)
+	for i := 0; i < 10; i++ {
+		if s.Failed(0, time.Hour) {
+			t.Fatal("breaker opened with a threshold of 0")
+		}
+	}
+	if !s.Allowed() {
+		t.Error("breaker with a threshold of 0 is not allowed")
+	}
+}
+
+func TestPickersSkip(t *testing.T) {
+	names := []string{
+		"round-robin",
+		"random",
+		"latency",
+		"least-conn",
+		"weighted-round-robin",
+		"weighted-random",
+		"failover",
+		"hash-client",
+		"hash-user",
+		"hash-host",
+	}
+
+	for _, name := range names {
+		picker, err := NewPicker(name, NewMonitor())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chains := []Chain{
+			{{Protocol: "socks5", Address: "1.1.1.1:1080"}},
+			{{Protocol: "socks5", Address: "2.2.2.2:1080"}},
+			{{Protocol: "socks5", Address: "3.3.3.3:1080"}},
+		}
+		for _, c := range chains {
+			picker.Add(c)
+		}
+		// picked chains are copies, identified by their first proxy
+		chains = picker.All()
+
+		tests := []struct {
+			name    string
+			session Session
+			// index of the only chain that may be picked, -1 for none
+			want int
+		}{
+			{"failed", Session{Failed: []Chain{chains[0], chains[2]}}, 1},
+			{"filter", Session{Filter: func(c Chain) bool { return &c[0] == &chains[2][0] }}, 2},
+			{"failed and filter", Session{Failed: []Chain{chains[0]}, Filter: func(c Chain) bool { return &c[0] != &chains[1][0] }}, 2},
+			{"all failed", Session{Failed: chains}, -1},
+		}
+
+		for _, test := range tests {
+			for i := 0; i < 20; i++ {
+				s := test.session
+				s.Client = "127.0.0.1"
+				s.Address = "example.com:443"
+				c := picker.Next(&s)
+				if test.want < 0 {
+					if c != nil {
+						t.Errorf("%s: %s: Next() = %s, want nil", name, test.name, c.String())
+					}
+				} else if c == nil || &c[0] != &chains[test.want][0] {
+					t.Errorf("%s: %s: Next() = %v, want %s", name, test.name, c, chains[test.want].String())
+				}
+			}
+		}
+	}
+}
@@ -1,53 +1,273 @@
 package proxy
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
-var globalKWArgs = map[string]string{}
+// state of a config file being loaded. `set` lines outside of chains apply
+// to the rest of the file and to the files it includes, but not to the file
+// that included it
+type parser struct {
+	config *Config
+	// used in errors, empty if not reading a file
+	file string
+	// includes are resolved relative to dir
+	dir string
+	// files being loaded, to detect include cycles
+	stack  []string
+	kwargs map[string]string
+}
+
+func newParser(c *Config) *parser {
+	return &parser{config: c, kwargs: map[string]string{}}
+}
+
+// loads a file with the KWArgs of p, which are not changed by it
+func (p *parser) loadFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range p.stack {
+		if f == abs {
+			return fmt.Errorf("include cycle %s", strings.Join(append(p.stack, abs), " -> "))
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	child := &parser{
+		config: p.config,
+		file:   path,
+		dir:    filepath.Dir(path),
+		stack:  append(p.stack, abs),
+		kwargs: p.kwargs,
+	}
+
+	return child.load(f)
+}
+
+// includes a file, or every file matching a glob in lexical order
+func (p *parser) include(pattern string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.dir, pattern)
+	}
+
+	files := []string{pattern}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		var err error
+		if files, err = filepath.Glob(pattern); err != nil {
+			return err
+		}
+	}
+
+	var errs ConfigErrors
+
+	for _, file := range files {
+		err := p.loadFile(file)
+		if e, ok := err.(ConfigErrors); ok {
+			errs = append(errs, e...)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// every line is loaded even if some have errors
+func (p *parser) load(r io.Reader) error {
+	c := p.config
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	var errs ConfigErrors
+
+	// locates err in the current line. fieldErrors point to their field,
+	// other errors to the field at index
+	fail := func(fields []string, cols []int, index int, err error) {
+		e := &ConfigError{File: p.file, Line: lineno, Err: err}
+		if fe, ok := err.(*fieldError); ok {
+			index = fe.index
+			e.Err = fe.err
+		}
+		if index < len(fields) {
+			e.Column = cols[index]
+			e.Token = fields[index]
+		}
+		errs = append(errs, e)
+	}
+
+	// picker of the group being declared
+	picker := c.Picker
+	ingroup := false
+	// `group` line of the group being declared
+	var group *ConfigError
+
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, cols, err := splitFields(line)
+		if se, ok := err.(*syntaxError); ok {
+			errs = append(errs, &ConfigError{File: p.file, Line: lineno, Column: se.col + 1, Token: se.token, Err: se.err})
+			continue
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "include":
+			if ingroup {
+				fail(fields, cols, 0, errors.New("include is not allowed inside groups"))
+				continue
+			}
+			if len(fields) != 2 {
+				fail(fields, cols, 0, fmt.Errorf("expected `include path`, got `%s`", strings.Join(fields, " ")))
+				continue
+			}
+			err := p.include(fields[1])
+			if e, ok := err.(ConfigErrors); ok {
+				errs = append(errs, e...)
+			} else if err != nil {
+				fail(fields, cols, 1, err)
+			}
+			continue
+		case "rule":
+			rule, err := c.parseRule(fields)
+			if err != nil {
+				fail(fields, cols, 0, err)
+				continue
+			}
+			rule.file, rule.line, rule.column = p.file, lineno, cols[3]
+			c.Router.Add(rule)
+			continue
+		case "group":
+			if ingroup {
+				fail(fields, cols, 0, errors.New("groups cannot be nested"))
+				continue
+			}
+			group = &ConfigError{File: p.file, Line: lineno, Column: cols[0], Token: fields[0]}
+			ingroup = true
+			if picker, err = c.parseGroup(fields); err != nil {
+				fail(fields, cols, 0, err)
+				// chains of the group are still checked
+				picker = &RoundRobin{}
+			}
+			continue
+		case "end":
+			if !ingroup {
+				fail(fields, cols, 0, errors.New("found `end` outside of a group"))
+				continue
+			}
+			if len(fields) != 1 {
+				fail(fields, cols, 1, fmt.Errorf("expected `end`, got `%s`", strings.Join(fields, " ")))
+			}
+			picker = c.Picker
+			ingroup = false
+			continue
+		}
+
+		chain, err := p.parseChain(fields)
+		if err != nil {
+			fail(fields, cols, 0, err)
+			continue
+		}
+
+		if len(chain) == 0 {
+			continue
+		}
+
+		picker.Add(chain)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, &ConfigError{File: p.file, Line: lineno + 1, Err: err})
+	}
+
+	if ingroup {
+		group.Err = errors.New("group is missing `end`")
+		errs = append(errs, group)
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	return nil
+}
 
 func parseFields(line string) ([]string, error) {
+	fields, _, err := splitFields(line)
+	return fields, err
+}
+
+// also returns the 1-based byte offset of each field
+func splitFields(line string) ([]string, []int, error) {
 	ret := make([]string, 0)
+	cols := make([]int, 0)
 	str := strings.Builder{}
+	start := 0
+
+	flush := func() {
+		if str.Len() != 0 {
+			ret = append(ret, str.String())
+			cols = append(cols, start+1)
+			str.Reset()
+		}
+	}
 
 	for i := 0; i < len(line); i++ {
 		r := rune(line[i])
 
 		switch r {
 		case '|':
-			if str.Len() != 0 {
-				ret = append(ret, str.String())
-				str.Reset()
-			}
+			flush()
 			ret = append(ret, "|")
+			cols = append(cols, i+1)
 		case ' ', '\t', '\r', '\n', '\v', '\f':
-			if str.Len() != 0 {
-				ret = append(ret, str.String())
-				str.Reset()
-			}
+			flush()
 		case '"', '\'':
-			if str.Len() != 0 {
-				ret = append(ret, str.String())
-				str.Reset()
-			}
+			flush()
 			unquoted, len, err := parseQuoted(line[i:])
 			if err != nil {
-				return nil, err
+				return nil, nil, &syntaxError{col: i, token: line[i:], err: err}
 			}
 			ret = append(ret, unquoted)
+			cols = append(cols, i+1)
 			i += len
 		default:
+			if str.Len() == 0 {
+				start = i
+			}
 			str.WriteRune(r)
 		}
 	}
 
-	if str.Len() != 0 {
-		ret = append(ret, str.String())
-	}
+	flush()
 
-	return ret, nil
+	return ret, cols, nil
 }
 
 func parseQuoted(line string) (string, int, error) {
@@ -71,7 +291,7 @@ func parseQuoted(line string) (string, int, error) {
 		switch r {
 		case '\\':
 			if linelen <= i+1 {
-				return "", 0, fmt.Errorf("config: string `%s` ended with \\", line)
+				return "", 0, fmt.Errorf("string `%s` ended with \\", line)
 			}
 			next := rune(line[i+1])
 			switch next {
@@ -103,19 +323,22 @@ func parseQuoted(line string) (string, int, error) {
 		}
 	}
 
-	return "", 0, fmt.Errorf("config: unterminated string `%s`", line)
+	return "", 0, fmt.Errorf("unterminated string `%s`", line)
 }
 
-func parseChain(args []string) (Chain, error) {
+func (p *parser) parseChain(args []string) (Chain, error) {
 	split := make([][]string, 0)
 	opts := make([]string, 0)
+	// index in args of the first field of each proxy
+	starts := []int{0}
 
-	for _, a := range args {
+	for i, a := range args {
 		if a == "|" {
 			tmp := make([]string, len(opts))
 			copy(tmp, opts)
 			split = append(split, tmp)
 			opts = opts[:0]
+			starts = append(starts, i+1)
 		} else {
 			opts = append(opts, a)
 		}
@@ -126,43 +349,75 @@ func parseChain(args []string) (Chain, error) {
 	r := make(Chain, 0, len(split))
 
 	var err error
-	kwargs := globalKWArgs
+	kwargs := p.kwargs
+
+	for i, opts := range split {
+		info := ProxyInfo{KWArgs: kwargs}
 
-	for _, opts := range split {
-		p := ProxyInfo{KWArgs: kwargs}
+		fail := func(offset int, err error) error {
+			index := starts[i] + offset
+			if index >= len(args) {
+				index = len(args) - 1
+			}
+			return &fieldError{index: index, err: err}
+		}
+
+		if len(opts) > 1 && strings.Contains(opts[0], "://") {
+			return nil, fail(1, fmt.Errorf("unexpected arguments after proxy uri %q", opts[0]))
+		}
 
 		switch len(opts) {
 		case 0:
-			return nil, errors.New("config: found invalid proxy chain")
+			return nil, fail(0, errors.New("found invalid proxy chain"))
 		case 1:
-			p.Protocol = opts[0]
+			if strings.Contains(opts[0], "://") {
+				uri, err := ParseURI(opts[0])
+				if err != nil {
+					return nil, fail(0, err)
+				}
+				uri.KWArgs = kwargs
+				if err := uri.Validate(); err != nil {
+					return nil, fail(0, err)
+				}
+				r = append(r, uri)
+				continue
+			}
+			info.Protocol = opts[0]
 		case 2:
-			p.Protocol = opts[0]
-			p.Address = opts[1]
+			info.Protocol = opts[0]
+			info.Address = opts[1]
 		default:
-			p.Protocol = opts[0]
-			p.Address = opts[1]
-			p.Args = opts[2:]
+			info.Protocol = opts[0]
+			info.Address = opts[1]
+			info.Args = opts[2:]
 		}
 
-		if isKWArgs(&p) {
-			kwargs, err = handleKWArgs(&p, kwargs)
+		if isKWArgs(&info) {
+			kwargs, err = handleKWArgs(&info, kwargs)
 			if err != nil {
-				return nil, err
+				return nil, fail(0, err)
+			}
+			// like includes, files are relative to the declaring file
+			if info.Protocol == "set" && info.Address == "TLSCAFile" && p.dir != "" && !filepath.IsAbs(info.Args[0]) {
+				kwargs["TLSCAFile"] = filepath.Join(p.dir, info.Args[0])
 			}
 			continue
 		}
 
 		if len(opts) < 2 {
-			return nil, errors.New("config: found invalid proxy chain")
+			return nil, fail(0, errors.New("found invalid proxy chain"))
+		}
+
+		if err := info.Validate(); err != nil {
+			return nil, fail(0, err)
 		}
 
-		r = append(r, p)
+		r = append(r, info)
 	}
 
 	if len(r) == 0 && len(split) >= 1 {
-		// changing global kwargs
-		globalKWArgs = kwargs
+		// changing kwargs of the file
+		p.kwargs = kwargs
 	}
 
 	return r, nil
@@ -186,7 +441,7 @@ func handleKWArgs(p *ProxyInfo, root map[string]string) (map[string]string, erro
 	switch p.Protocol {
 	case "set":
 		if len(p.Args) != 1 {
-			return nil, fmt.Errorf("config: expected `set key value`, got `set %s`", p.Address)
+			return nil, fmt.Errorf("expected `set key value`, got `set %s`", p.Address)
 		}
 		r[p.Address] = p.Args[0]
 	case "unset":
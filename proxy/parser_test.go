@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		line   string
+		fields []string
+		cols   []int
+	}{
+		{"", []string{}, []int{}},
+		{"  \t ", []string{}, []int{}},
+		{"socks5 1.2.3.4:1080", []string{"socks5", "1.2.3.4:1080"}, []int{1, 8}},
+		{"  socks5\t1.2.3.4:1080  ", []string{"socks5", "1.2.3.4:1080"}, []int{3, 10}},
+		{"set a b|socks5 h:1", []string{"set", "a", "b", "|", "socks5", "h:1"}, []int{1, 5, 7, 8, 9, 16}},
+		{"set a 'b c' | x", []string{"set", "a", "b c", "|", "x"}, []int{1, 5, 7, 13, 15}},
+		{`set a "b\"c"d`, []string{"set", "a", `b"c`, "d"}, []int{1, 5, 7, 13}},
+		{`rule regex '^a\\.b$' direct`, []string{"rule", "regex", `^a\.b$`, "direct"}, []int{1, 6, 12, 22}},
+	}
+
+	for _, test := range tests {
+		fields, cols, err := splitFields(test.line)
+		if err != nil {
+			t.Errorf("splitFields(%q): unexpected error: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, test.fields) || !reflect.DeepEqual(cols, test.cols) {
+			t.Errorf("splitFields(%q) = %q, %v, want %q, %v", test.line, fields, cols, test.fields, test.cols)
+		}
+	}
+}
+
+func TestSplitFieldsErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		col  int
+	}{
+		{`socks5 "unterminated`, 7},
+		{`set a 'b`, 6},
+		{`set a "b\`, 6},
+	}
+
+	for _, test := range tests {
+		_, _, err := splitFields(test.line)
+		var serr *syntaxError
+		if !errors.As(err, &serr) {
+			t.Errorf("splitFields(%q) returned %v, want a syntax error", test.line, err)
+			continue
+		}
+		if serr.col != test.col {
+			t.Errorf("splitFields(%q) error at column %d, want %d", test.line, serr.col, test.col)
+		}
+	}
+}
+
+func TestParseChainTLSCAFile(t *testing.T) {
+	tests := []struct {
+		dir  string
+		file string
+		want string
+	}{
+		{"/etc/sockx", "ca.pem", "/etc/sockx/ca.pem"},
+		{"/etc/sockx", "../ca.pem", "/etc/ca.pem"},
+		{"/etc/sockx", "/tmp/ca.pem", "/tmp/ca.pem"},
+		// configs read from stdin or --proxy have no directory
+		{"", "ca.pem", "ca.pem"},
+	}
+
+	for _, test := range tests {
+		p := newParser(&Config{})
+		p.dir = test.dir
+		if _, err := p.parseChain([]string{"set", "TLSCAFile", test.file}); err != nil {
+			t.Errorf("parseChain(set TLSCAFile %s): unexpected error: %s", test.file, err)
+			continue
+		}
+		if got := p.kwargs["TLSCAFile"]; got != test.want {
+			t.Errorf("TLSCAFile %q in %q resolved to %q, want %q", test.file, test.dir, got, test.want)
+		}
+	}
+}
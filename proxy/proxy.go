@@ -1,13 +1,20 @@
 package proxy
 
 import (
-	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/sloweax/sockx/proxy/http"
 	"github.com/sloweax/sockx/proxy/shadowsocks"
 	"github.com/sloweax/sockx/proxy/socks4"
 	"github.com/sloweax/sockx/proxy/socks5"
@@ -18,15 +25,65 @@ type ProxyInfo struct {
 	Address  string
 	Args     []string
 	KWArgs   map[string]string
+
+	// built by Validate, so TLSCAFile is only read when configs are loaded
+	tls       *tls.Config
+	validated bool
 }
 
 type Chain []ProxyInfo
 
 type ChainPicker interface {
 	Add(Chain)
-	Next() Chain
+	// s holds the state of the connection being made, it may be nil.
+	// chains in s.Failed or rejected by s.Filter are never returned, nil is
+	// returned if there are none left
+	Next(s *Session) Chain
 	All() []Chain
 	Len() int
+	// replaces every chain, keeping the state of the picker
+	Replace([]Chain)
+}
+
+// state of a single connection attempt, shared between retries
+type Session struct {
+	// ip address of the client, empty if unknown
+	Client string
+	// authenticated username, empty if none
+	User string
+	// destination host:port, empty if unknown
+	Address string
+	// chains that already failed, in order
+	Failed []Chain
+	// if set, only chains it returns true for are picked. used for
+	// connections that not every chain is able to make
+	Filter func(Chain) bool
+}
+
+// destination host without port
+func (s *Session) Host() string {
+	host, _, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return s.Address
+	}
+	return host
+}
+
+// whether c must not be picked for s, because it failed or does not pass
+// s.Filter
+func (s *Session) skips(c Chain) bool {
+	if s == nil {
+		return false
+	}
+	if s.Filter != nil && !s.Filter(c) {
+		return true
+	}
+	for _, f := range s.Failed {
+		if &f[0] == &c[0] {
+			return true
+		}
+	}
+	return false
 }
 
 type ProxyDialer interface {
@@ -36,7 +93,31 @@ type ProxyDialer interface {
 	DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error)
 }
 
+// dialers able to carry udp traffic
+type PacketProxyDialer interface {
+	ProxyDialer
+	ListenPacketContext(ctx context.Context) (net.PacketConn, error)
+}
+
+// dialers able to accept inbound connections
+type BindProxyDialer interface {
+	ProxyDialer
+	BindContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error)
+}
+
+type BindConn interface {
+	net.Conn
+	// address the proxy is listening on
+	BoundAddr() net.Addr
+	// waits for the inbound connection and returns its address
+	Accept() (net.Addr, error)
+}
+
 func (p *ProxyInfo) ToDialer() (ProxyDialer, error) {
+	if p.Protocol == "https" || strings.HasSuffix(p.Protocol, "+tls") {
+		return p.withTLS().ToDialer()
+	}
+
 	switch p.Protocol {
 	case "ss":
 		return p.ToShadowSocks()
@@ -44,11 +125,31 @@ func (p *ProxyInfo) ToDialer() (ProxyDialer, error) {
 		return p.ToSOCKS5()
 	case "socks4", "socks4a":
 		return p.ToSOCKS4()
+	case "http":
+		return p.ToHTTP()
 	default:
 		return nil, fmt.Errorf("cannot convert %s to dialer", p.Protocol)
 	}
 }
 
+// converts `https` and `protocol+tls` to their plain protocol with TLS enabled
+func (p *ProxyInfo) withTLS() *ProxyInfo {
+	r := *p
+	if r.Protocol == "https" {
+		r.Protocol = "http"
+	} else {
+		r.Protocol = strings.TrimSuffix(r.Protocol, "+tls")
+	}
+
+	r.KWArgs = make(map[string]string, len(p.KWArgs)+1)
+	for k, v := range p.KWArgs {
+		r.KWArgs[k] = v
+	}
+	r.KWArgs["TLS"] = "on"
+
+	return &r
+}
+
 func (p *ProxyInfo) ToSOCKS4() (ProxyDialer, error) {
 	if len(p.Args) > 1 {
 		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
@@ -63,6 +164,23 @@ func (p *ProxyInfo) ToSOCKS4() (ProxyDialer, error) {
 	return socks4.NewDialer("tcp", p.Address, p.KWArgs, config), nil
 }
 
+func (p *ProxyInfo) ToHTTP() (ProxyDialer, error) {
+	config := http.Config{}
+
+	switch len(p.Args) {
+	case 0:
+	case 2:
+		config.Password = p.Args[1]
+		fallthrough
+	case 1:
+		config.Username = p.Args[0]
+	default:
+		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
+	}
+
+	return http.NewDialer("tcp", p.Address, p.KWArgs, config), nil
+}
+
 func (p *ProxyInfo) ToShadowSocks() (ProxyDialer, error) {
 	network := "tcp"
 	password := ""
@@ -116,6 +234,7 @@ func (p *ProxyInfo) ToSOCKS5() (ProxyDialer, error) {
 	}
 }
 
+// KWArgs are sorted by key, so equal proxies always have the same string
 func (p *ProxyInfo) String() string {
 	a := p.Protocol
 	if len(p.Address) != 0 {
@@ -124,14 +243,111 @@ func (p *ProxyInfo) String() string {
 	for _, arg := range p.Args {
 		a += " " + fmt.Sprintf("%q", arg)
 	}
-	for k, v := range p.KWArgs {
-		a += fmt.Sprintf(" %s=%q", k, v)
+	keys := make([]string, 0, len(p.KWArgs))
+	for k := range p.KWArgs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		a += fmt.Sprintf(" %s=%q", k, p.KWArgs[k])
 	}
 	return a
 }
 
+func (c Chain) String() string {
+	a := make([]string, len(c))
+	for i, p := range c {
+		a[i] = p.String()
+	}
+	return strings.Join(a, " | ")
+}
+
+// KWArgs holding durations
+var durationKWArgs = []string{"ConnTimeout", "ReadTimeout", "WriteTimeout", "ChainConnTimeout"}
+
+// checks that p can be converted to a dialer and that its KWArgs are valid,
+// so errors are found when loading configs instead of when connecting
+func (p *ProxyInfo) Validate() error {
+	dialer, err := p.ToDialer()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range durationKWArgs {
+		if value, ok := p.KWArgs[key]; ok {
+			if _, err := time.ParseDuration(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+
+	if _, err := (Chain{*p}).Weight(); err != nil {
+		return err
+	}
+
+	tlsconfig, err := tlsConfig(dialer)
+	if err != nil {
+		return err
+	}
+
+	p.tls, p.validated = tlsconfig, true
+	return nil
+}
+
+// whether connections through c are able to carry udp, which requires a
+// single proxy supporting it without TLS (see Dialer.ListenPacket)
+func (c Chain) UDP() bool {
+	if len(c) != 1 {
+		return false
+	}
+
+	d, err := c.ToDialer()
+	if err != nil {
+		return false
+	}
+
+	if _, ok := d.proxies[0].(PacketProxyDialer); !ok {
+		return false
+	}
+
+	tlsconfig, err := d.tlsConfig(0)
+	return err == nil && tlsconfig == nil
+}
+
+// whether the last proxy of c is able to accept inbound connections (see
+// Dialer.BindContext)
+func (c Chain) Bind() bool {
+	if len(c) == 0 {
+		return false
+	}
+
+	d, err := c[len(c)-1].ToDialer()
+	if err != nil {
+		return false
+	}
+
+	_, ok := d.(BindProxyDialer)
+	return ok
+}
+
+// relative share of connections for weighted pickers, defaults to 1
+func (c Chain) Weight() (int, error) {
+	s, ok := c[0].KWArgs["Weight"]
+	if !ok {
+		return 1, nil
+	}
+
+	w, err := strconv.Atoi(s)
+	if err != nil || w < 1 {
+		return 0, fmt.Errorf("Weight: expected a positive integer, got %q", s)
+	}
+
+	return w, nil
+}
+
 func (c Chain) ToDialer() (*Dialer, error) {
 	dialers := make([]ProxyDialer, len(c))
+	tlsconfigs := make([]*tls.Config, len(c))
 
 	for i, p := range c {
 		d, err := p.ToDialer()
@@ -139,44 +355,256 @@ func (c Chain) ToDialer() (*Dialer, error) {
 			return nil, err
 		}
 		dialers[i] = d
+
+		if p.validated {
+			tlsconfigs[i] = p.tls
+		} else if tlsconfigs[i], err = tlsConfig(d); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", d.Protocol(), d.String(), err)
+		}
 	}
 
-	return New(dialers...), nil
+	d := New(dialers...)
+	d.chain = c
+	d.tls = tlsconfigs
+	return d, nil
+}
+
+// everything that can be declared in a config file. once in use, it must
+// only be modified with Replace
+type Config struct {
+	mutex sync.RWMutex
+	// chains declared outside of groups
+	Picker ChainPicker
+	Router *Router
+	Groups map[string]ChainPicker
+	// given to pickers of groups, may be nil
+	Monitor *Monitor
+}
+
+func NewPicker(name string, m *Monitor) (ChainPicker, error) {
+	switch name {
+	case "round-robin":
+		return &RoundRobin{Monitor: m}, nil
+	case "random":
+		return &Random{Monitor: m}, nil
+	case "latency":
+		return &Latency{Monitor: m}, nil
+	case "least-conn":
+		return &LeastConn{Monitor: m}, nil
+	case "weighted-round-robin":
+		return &WeightedRoundRobin{Monitor: m}, nil
+	case "weighted-random":
+		return &WeightedRandom{Monitor: m}, nil
+	case "failover":
+		return &Failover{Monitor: m}, nil
+	case "hash-client":
+		return &Hash{Key: func(s *Session) string { return s.Client }, Monitor: m}, nil
+	case "hash-user":
+		return &Hash{Key: func(s *Session) string { return s.User }, Monitor: m}, nil
+	case "hash-host":
+		return &Hash{Key: (*Session).Host, Monitor: m}, nil
+	default:
+		return nil, fmt.Errorf("unknown picker %q", name)
+	}
 }
 
 func LoadPicker(p ChainPicker, r io.Reader) error {
-	scanner := bufio.NewScanner(r)
+	return LoadConfig(&Config{Picker: p}, r)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
+// includes are resolved relative to the working directory. returns
+// ConfigErrors if the config is invalid. c must not be loaded concurrently
+func LoadConfig(c *Config, r io.Reader) error {
+	return newParser(c).load(r)
+}
 
-		fields, err := parseFields(line)
-		if err != nil {
-			return err
-		}
+// includes are resolved relative to the directory of path. returns
+// ConfigErrors if the config is invalid. c must not be loaded concurrently
+func LoadConfigFile(c *Config, path string) error {
+	return newParser(c).loadFile(path)
+}
 
-		if len(fields) == 0 {
-			continue
-		}
+// checks that every rule target exists. must be called after all
+// files are loaded since rules may refer to groups declared later. returns
+// ConfigErrors if any target is invalid
+func (c *Config) Validate() error {
+	if c.Router == nil {
+		return nil
+	}
 
-		chain, err := parseChain(fields)
-		if err != nil {
-			return err
+	var errs ConfigErrors
+
+	for _, rule := range c.Router.All() {
+		switch rule.Target {
+		case TargetDirect, TargetReject, TargetDefault:
+			continue
 		}
 
-		if len(chain) == 0 {
+		var err error
+		if group, ok := c.Groups[rule.Target]; !ok {
+			err = fmt.Errorf("`%s` refers to unknown group %q", rule.String(), rule.Target)
+		} else if group.Len() == 0 {
+			err = fmt.Errorf("`%s` refers to empty group %q", rule.String(), rule.Target)
+		} else {
 			continue
 		}
 
-		p.Add(chain)
+		errs = append(errs, &ConfigError{
+			File:   rule.file,
+			Line:   rule.line,
+			Column: rule.column,
+			Token:  rule.Target,
+			Err:    err,
+		})
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	if len(errs) != 0 {
+		return errs
 	}
 
 	return nil
 }
+
+// returns the target chosen by routing rules and its picker, which is nil
+// for direct and reject
+func (c *Config) Route(user, address string) (string, ChainPicker) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	target := c.Router.Route(user, address)
+	return target, c.target(target)
+}
+
+// wraps pc so that datagrams sent to addresses routed to reject for user
+// are dropped. other targets are not applied since every datagram of an
+// udp association goes through the same chain
+func (c *Config) FilterPacketConn(pc net.PacketConn, user string) net.PacketConn {
+	return &filterPacketConn{PacketConn: pc, config: c, user: user}
+}
+
+type filterPacketConn struct {
+	net.PacketConn
+	config *Config
+	user   string
+}
+
+func (c *filterPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if target, _ := c.config.Route(c.user, addr.String()); target == TargetReject {
+		// like any lost datagram, the sender is not told
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// returns the picker for a rule target, nil for direct and reject
+func (c *Config) Target(target string) ChainPicker {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.target(target)
+}
+
+func (c *Config) target(target string) ChainPicker {
+	switch target {
+	case TargetDefault:
+		return c.Picker
+	case TargetDirect, TargetReject:
+		return nil
+	default:
+		return c.Groups[target]
+	}
+}
+
+// returns the default picker and the pickers of every group
+func (c *Config) Pickers() []ChainPicker {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pickers()
+}
+
+func (c *Config) pickers() []ChainPicker {
+	pickers := make([]ChainPicker, 0, len(c.Groups)+1)
+	pickers = append(pickers, c.Picker)
+	for _, group := range c.Groups {
+		pickers = append(pickers, group)
+	}
+	return pickers
+}
+
+// replaces chains, groups and rules by the ones in n, which must not be used
+// afterwards. the default picker keeps its state, and chains that did not
+// change keep their stats
+func (c *Config) Replace(n *Config) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var old, chains []Chain
+	for _, picker := range c.pickers() {
+		old = append(old, picker.All()...)
+	}
+	for _, picker := range n.pickers() {
+		chains = append(chains, picker.All()...)
+	}
+
+	c.Monitor.Replace(old, chains)
+	c.Picker.Replace(n.Picker.All())
+	c.Groups = n.Groups
+	c.Router = n.Router
+}
+
+// declaring a group more than once adds chains to the existing one
+func (c *Config) parseGroup(fields []string) (ChainPicker, error) {
+	if c.Groups == nil {
+		return nil, errors.New("groups are not supported")
+	}
+
+	name := ""
+	pickername := "round-robin"
+
+	switch len(fields) {
+	case 3:
+		pickername = fields[2]
+		fallthrough
+	case 2:
+		name = fields[1]
+	default:
+		return nil, fmt.Errorf("expected `group name [picker]`, got `%s`", strings.Join(fields, " "))
+	}
+
+	switch name {
+	case TargetDirect, TargetReject, TargetDefault:
+		return nil, &fieldError{index: 1, err: fmt.Errorf("%q is a reserved group name", name)}
+	}
+
+	picker, err := NewPicker(pickername, c.Monitor)
+	if err != nil {
+		return nil, &fieldError{index: 2, err: err}
+	}
+
+	if existing, ok := c.Groups[name]; ok {
+		if reflect.TypeOf(existing) != reflect.TypeOf(picker) {
+			return nil, &fieldError{index: 2, err: fmt.Errorf("group %q was already declared with a different picker", name)}
+		}
+		return existing, nil
+	}
+
+	c.Groups[name] = picker
+	return picker, nil
+}
+
+func (c *Config) parseRule(fields []string) (Rule, error) {
+	if c.Router == nil {
+		return Rule{}, errors.New("rules are not supported")
+	}
+
+	if len(fields) != 4 {
+		return Rule{}, fmt.Errorf("expected `rule type value target`, got `%s`", strings.Join(fields, " "))
+	}
+
+	rule, err := NewRule(fields[1], fields[2], fields[3])
+	if errors.Is(err, errUnknownRule) {
+		return Rule{}, &fieldError{index: 1, err: err}
+	} else if err != nil {
+		return Rule{}, &fieldError{index: 2, err: err}
+	}
+
+	return rule, nil
+}
@@ -6,8 +6,9 @@ import (
 )
 
 type Random struct {
-	mutex  sync.RWMutex
-	chains []Chain
+	mutex   sync.RWMutex
+	chains  []Chain
+	Monitor *Monitor
 }
 
 func (r *Random) Add(c Chain) {
@@ -16,13 +17,24 @@ func (r *Random) Add(c Chain) {
 	r.chains = append(r.chains, c)
 }
 
-func (r *Random) Next() Chain {
+// skips unhealthy chains unless every chain is unhealthy
+func (r *Random) Next(s *Session) Chain {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
-	chain := r.chains[rand.Int()%len(r.chains)]
+	chains := r.Monitor.Available(r.chains, s)
+	if len(chains) == 0 {
+		return nil
+	}
+	chain := chains[rand.Int()%len(chains)]
 	return chain
 }
 
+func (r *Random) Replace(chains []Chain) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.chains = append([]Chain{}, chains...)
+}
+
 func (r *Random) Len() int {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
@@ -5,9 +5,10 @@ import (
 )
 
 type RoundRobin struct {
-	mutex  sync.RWMutex
-	index  int
-	chains []Chain
+	mutex   sync.RWMutex
+	index   int
+	chains  []Chain
+	Monitor *Monitor
 }
 
 func (r *RoundRobin) Add(c Chain) {
@@ -16,14 +17,38 @@ func (r *RoundRobin) Add(c Chain) {
 	r.chains = append(r.chains, c)
 }
 
-func (r *RoundRobin) Next() Chain {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	chain := r.chains[r.index%len(r.chains)]
-	r.index += 1
+// skips unhealthy chains unless every chain is unhealthy
+func (r *RoundRobin) Next(s *Session) Chain {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fallback := -1
+	for i := 0; i < len(r.chains); i++ {
+		chain := r.chains[(r.index+i)%len(r.chains)]
+		if s.skips(chain) {
+			continue
+		}
+		if r.Monitor.Healthy(chain) {
+			r.index += i + 1
+			return chain
+		}
+		if fallback == -1 {
+			fallback = i
+		}
+	}
+	if fallback == -1 {
+		return nil
+	}
+	chain := r.chains[(r.index+fallback)%len(r.chains)]
+	r.index += fallback + 1
 	return chain
 }
 
+func (r *RoundRobin) Replace(chains []Chain) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.chains = append([]Chain{}, chains...)
+}
+
 func (r *RoundRobin) Len() int {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// any other target is the name of a group
+const (
+	// connect without using any proxy
+	TargetDirect = "direct"
+	// refuse the connection
+	TargetReject = "reject"
+	// use chains declared outside of groups
+	TargetDefault = "default"
+)
+
+type Rule struct {
+	Type   string
+	Value  string
+	Target string
+
+	regex *regexp.Regexp
+	cidr  *net.IPNet
+	ports [][2]uint16
+
+	// where the target was declared, used in errors
+	file   string
+	line   int
+	column int
+}
+
+var errUnknownRule = errors.New("unknown rule type")
+
+// rules are matched in the order they were added, the first match wins
+type Router struct {
+	rules []Rule
+}
+
+func NewRule(t, value, target string) (Rule, error) {
+	r := Rule{Type: t, Value: value, Target: target}
+
+	switch t {
+	case "user":
+	case "domain", "domain-suffix", "domain-keyword":
+		r.Value = strings.ToLower(strings.TrimSuffix(value, "."))
+	case "regex":
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.regex = regex
+	case "cidr":
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return Rule{}, fmt.Errorf("invalid ip %q", value)
+			}
+			bits := net.IPv6len * 8
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = net.IPv4len * 8
+			}
+			r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			break
+		}
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.cidr = cidr
+	case "port":
+		for _, s := range strings.Split(value, ",") {
+			lo, hi, ok := strings.Cut(s, "-")
+			if !ok {
+				hi = lo
+			}
+			start, err := strconv.ParseUint(lo, 10, 16)
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid port range %q", s)
+			}
+			end, err := strconv.ParseUint(hi, 10, 16)
+			if err != nil || end < start {
+				return Rule{}, fmt.Errorf("invalid port range %q", s)
+			}
+			r.ports = append(r.ports, [2]uint16{uint16(start), uint16(end)})
+		}
+	default:
+		return Rule{}, fmt.Errorf("%w %q", errUnknownRule, t)
+	}
+
+	return r, nil
+}
+
+// host is empty if the destination is unknown
+func (r *Rule) Match(user, host string, port uint16) bool {
+	if r.Type == "user" {
+		return user == r.Value
+	}
+
+	if len(host) == 0 {
+		return false
+	}
+
+	switch r.Type {
+	case "domain":
+		return strings.ToLower(host) == r.Value
+	case "domain-suffix":
+		host = strings.ToLower(host)
+		return host == r.Value || strings.HasSuffix(host, "."+r.Value)
+	case "domain-keyword":
+		return strings.Contains(strings.ToLower(host), r.Value)
+	case "regex":
+		return r.regex.MatchString(host)
+	case "cidr":
+		ip := net.ParseIP(host)
+		return ip != nil && r.cidr.Contains(ip)
+	case "port":
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	return fmt.Sprintf("rule %s %q %s", r.Type, r.Value, r.Target)
+}
+
+func (r *Router) Add(rule Rule) {
+	r.rules = append(r.rules, rule)
+}
+
+func (r *Router) All() []Rule {
+	return r.rules
+}
+
+func (r *Router) Len() int {
+	return len(r.rules)
+}
+
+// returns the target of the first rule matching the authenticated user and
+// address (host:port), or TargetDefault if none matched. both may be empty
+func (r *Router) Route(user, address string) string {
+	var (
+		host string
+		port uint64
+	)
+
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		if port, err = strconv.ParseUint(p, 10, 16); err == nil {
+			host = h
+		}
+	}
+
+	for i := range r.rules {
+		if r.rules[i].Match(user, host, uint16(port)) {
+			return r.rules[i].Target
+		}
+	}
+
+	return TargetDefault
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRouterRoute(t *testing.T) {
+	router := &Router{}
+
+	for _, r := range [][3]string{
+		{"user", "alice", "users"},
+		{"domain", "Example.com.", "domain"},
+		{"domain-suffix", "example.org", "suffix"},
+		{"domain-keyword", "ads", TargetReject},
+		{"regex", `^(www|api)\.example\.net$`, "regex"},
+		{"cidr", "10.0.0.0/8", "cidr"},
+		{"cidr", "192.168.0.1", "ip"},
+		{"cidr", "2001:db8::/32", "cidr6"},
+		{"port", "25,465,587", "mail"},
+		{"port", "8000-9000", "range"},
+	} {
+		rule, err := NewRule(r[0], r[1], r[2])
+		if err != nil {
+			t.Fatalf("NewRule(%q, %q, %q): %s", r[0], r[1], r[2], err)
+		}
+		router.Add(rule)
+	}
+
+	tests := []struct {
+		user    string
+		address string
+		want    string
+	}{
+		{"alice", "1.2.3.4:80", "users"},
+		{"alice", "", "users"},
+		{"bob", "1.2.3.4:80", TargetDefault},
+		{"", "example.com:443", "domain"},
+		{"", "EXAMPLE.COM:443", "domain"},
+		{"", "www.example.com:443", TargetDefault},
+		{"", "example.org:443", "suffix"},
+		{"", "www.example.org:443", "suffix"},
+		{"", "notexample.org:443", TargetDefault},
+		{"", "cdn.ads.net:443", TargetReject},
+		{"", "api.example.net:443", "regex"},
+		{"", "apiexample.net:443", TargetDefault},
+		{"", "10.1.2.3:443", "cidr"},
+		{"", "11.1.2.3:443", TargetDefault},
+		{"", "192.168.0.1:443", "ip"},
+		{"", "192.168.0.2:443", TargetDefault},
+		{"", "[2001:db8::1]:443", "cidr6"},
+		// domain names are not resolved
+		{"", "localhost:443", TargetDefault},
+		{"", "1.2.3.4:465", "mail"},
+		{"", "1.2.3.4:466", TargetDefault},
+		{"", "1.2.3.4:8000", "range"},
+		{"", "1.2.3.4:9000", "range"},
+		{"", "1.2.3.4:9001", TargetDefault},
+		{"", "1.2.3.4", TargetDefault},
+		{"", "", TargetDefault},
+	}
+
+	for _, test := range tests {
+		if got := router.Route(test.user, test.address); got != test.want {
+			t.Errorf("Route(%q, %q) = %q, want %q", test.user, test.address, got, test.want)
+		}
+	}
+}
+
+func TestNewRuleErrors(t *testing.T) {
+	tests := [][2]string{
+		{"regex", "("},
+		{"cidr", "1.2.3"},
+		{"cidr", "10.0.0.0/33"},
+		{"port", "0x10"},
+		{"port", "70000"},
+		{"port", "9000-8000"},
+		{"port", "80,"},
+	}
+
+	for _, test := range tests {
+		if _, err := NewRule(test[0], test[1], TargetDirect); err == nil {
+			t.Errorf("NewRule(%q, %q) succeeded, want error", test[0], test[1])
+		}
+	}
+
+	if _, err := NewRule("domainx", "example.com", TargetDirect); !errors.Is(err, errUnknownRule) {
+		t.Errorf("NewRule with unknown type returned %v, want errUnknownRule", err)
+	}
+}
+
+type recordPacketConn struct {
+	net.PacketConn
+	sent []string
+}
+
+func (c *recordPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent = append(c.sent, addr.String())
+	return len(b), nil
+}
+
+func TestFilterPacketConn(t *testing.T) {
+	router := &Router{}
+	for _, r := range [][3]string{
+		{"cidr", "10.0.0.0/8", TargetReject},
+		{"port", "53", TargetDirect},
+	} {
+		rule, err := NewRule(r[0], r[1], r[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.Add(rule)
+	}
+
+	rec := &recordPacketConn{}
+	pc := (&Config{Router: router}).FilterPacketConn(rec, "")
+
+	for _, addr := range []string{"10.1.2.3:53", "1.2.3.4:53", "1.2.3.4:443", "10.0.0.1:443"} {
+		uaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := pc.WriteTo([]byte("data"), uaddr); n != 4 || err != nil {
+			t.Errorf("WriteTo(%s) = %d, %v, want 4, nil", addr, n, err)
+		}
+	}
+
+	want := []string{"1.2.3.4:53", "1.2.3.4:443"}
+	if !reflect.DeepEqual(rec.sent, want) {
+		t.Errorf("sent to %q, want %q", rec.sent, want)
+	}
+}
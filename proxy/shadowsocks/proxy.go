@@ -2,6 +2,7 @@ package shadowsocks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
@@ -65,6 +66,36 @@ func (s *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 	}
 }
 
+func (s *Dialer) ListenPacketContext(ctx context.Context) (net.PacketConn, error) {
+	if s.network != "tcp" {
+		return nil, errors.New("udp requires a tcp proxy address")
+	}
+
+	resolver := net.Resolver{}
+	host, port, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	nport, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &net.UDPAddr{IP: ips[0].IP, Port: nport, Zone: ips[0].Zone}
+	return &PacketConn{PacketConn: s.cipher.PacketConn(pc), server: server}, nil
+}
+
 func NewDialer(network, address string, kwargs map[string]string, method, password string) (*Dialer, error) {
 	d := new(Dialer)
 	d.network = network
@@ -79,3 +110,51 @@ func NewDialer(network, address string, kwargs map[string]string, method, passwo
 
 	return d, nil
 }
+
+type PacketConn struct {
+	net.PacketConn
+	server net.Addr
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if from.String() != c.server.String() {
+			continue
+		}
+
+		target := socks.SplitAddr(buf[:n])
+		if target == nil {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", target.String())
+		if err != nil {
+			continue
+		}
+
+		return copy(b, buf[len(target):n]), addr, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socks.ParseAddr(addr.String())
+	if target == nil {
+		return 0, fmt.Errorf("failed to parse address %q", addr)
+	}
+
+	buf := make([]byte, 0, len(target)+len(b))
+	buf = append(buf, target...)
+	buf = append(buf, b...)
+
+	if _, err := c.PacketConn.WriteTo(buf, c.server); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,138 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+type Server struct {
+	mutex    sync.RWMutex
+	closed   bool
+	listener net.Listener
+}
+
+type Request struct {
+	Cmd    byte
+	Addr   Addr
+	UserID string
+}
+
+func NewServer() *Server {
+	s := new(Server)
+	s.closed = true
+	return s
+}
+
+func (s *Server) Listen(network, address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		return errors.New("server is already listening")
+	}
+	var err error
+	s.closed = false
+	s.listener, err = net.Listen(network, address)
+	return err
+}
+
+func (s *Server) Accept() (net.Conn, error) {
+	if s.Closed() {
+		return nil, errors.New("server is closed")
+	}
+	return s.listener.Accept()
+}
+
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errors.New("server is already closed")
+	}
+	s.closed = true
+	return s.listener.Close()
+}
+
+func (s *Server) Closed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.closed
+}
+
+// reads the client request. replying to it is left to the caller
+func (s *Server) Handle(conn net.Conn) (Request, error) {
+	buf := make([]byte, 2+2+net.IPv4len)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return Request{}, err
+	}
+
+	if buf[0] != Version {
+		return Request{}, errors.New("unknown request version")
+	}
+
+	req := Request{Cmd: buf[1]}
+	req.Addr.port = binary.BigEndian.Uint16(buf[2:4])
+	ip := net.IP(buf[4:8])
+
+	userid, err := readString(conn)
+	if err != nil {
+		return Request{}, err
+	}
+	req.UserID = userid
+
+	// socks4a: 0.0.0.x (x != 0) means the hostname follows the userid
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readString(conn)
+		if err != nil {
+			return Request{}, err
+		}
+		if len(host) == 0 {
+			return Request{}, errors.New("empty hostname")
+		}
+		req.Addr.host = host
+		req.Addr.t = AtypDomainName
+	} else {
+		req.Addr.host = ip.String()
+		req.Addr.t = AtypIPv4
+	}
+
+	if req.Cmd != CmdConnect {
+		s.Reply(conn, ReplyRejected, Addr{})
+		return Request{}, errors.New("command not supported")
+	}
+
+	return req, nil
+}
+
+func (s *Server) Reply(w io.Writer, reply byte, addr Addr) error {
+	buf := make([]byte, 0, 2+2+net.IPv4len)
+	buf = append(buf, 0, reply)
+	buf = binary.BigEndian.AppendUint16(buf, addr.port)
+	ip := net.ParseIP(addr.host).To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	buf = append(buf, ip...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// reads a null terminated string
+func readString(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == 255 {
+			return "", errors.New("string is too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
@@ -14,3 +14,18 @@ type Conn struct {
 func (c *Conn) BoundAddr() net.Addr {
 	return &c.bnd
 }
+
+// waits for the second BIND reply and returns the address of the
+// connecting host
+func (c *Conn) Accept() (net.Addr, error) {
+	reply, addr, err := readResponse(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := reply.Err(); err != nil {
+		return nil, err
+	}
+
+	return &addr, nil
+}
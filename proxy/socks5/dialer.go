@@ -63,7 +63,7 @@ func (d *Dialer) request(rw io.ReadWriter, cmd Command, addr string) error {
 	return err
 }
 
-func (d *Dialer) response(rw io.ReadWriter) (Reply, Addr, error) {
+func readResponse(rw io.ReadWriter) (Reply, Addr, error) {
 	buf := make([]byte, 3)
 
 	if _, err := io.ReadFull(rw, buf); err != nil {
@@ -173,9 +173,74 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 		return nil, errors.New("tcp only")
 	}
 
+	c, err := d.handshake(ctx, conn, CmdConnect, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// asks the proxy to listen for an inbound connection from address. the
+// listening address is available via Conn.BoundAddr and Conn.Accept waits
+// for the connection
+func (d *Dialer) BindContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("tcp only")
+	}
+
+	c, err := d.handshake(ctx, conn, CmdBind, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// starts an udp association. datagrams are sent directly to the relay
+// address returned by the proxy, so it must be reachable from this host
+func (d *Dialer) ListenPacketContext(ctx context.Context) (net.PacketConn, error) {
+	if d.network != "tcp" {
+		return nil, errors.New("udp associate requires a tcp proxy")
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, d.network, d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.handshake(ctx, conn, CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", c.bnd.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if relay.IP.IsUnspecified() {
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p := &PacketConn{PacketConn: pc, ctrl: conn, relay: relay}
+	go p.watch()
+
+	return p, nil
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, cmd Command, address string) (*Conn, error) {
 	type result struct {
 		err  error
-		conn net.Conn
+		conn *Conn
 	}
 
 	cresult := make(chan result, 1)
@@ -193,12 +258,12 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 			return
 		}
 
-		if err = d.request(conn, CmdConnect, address); err != nil {
+		if err = d.request(conn, cmd, address); err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		reponse, bnd, err := d.response(conn)
+		reponse, bnd, err := readResponse(conn)
 		if err != nil {
 			cresult <- result{err: err}
 			return
@@ -215,7 +280,11 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 		conn.Close()
 		return nil, ctx.Err()
 	case result := <-cresult:
-		return result.conn, result.err
+		if result.err != nil {
+			conn.Close()
+			return nil, result.err
+		}
+		return result.conn, nil
 	}
 
 }
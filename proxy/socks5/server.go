@@ -1,21 +1,36 @@
 package socks5
 
 import (
+	"crypto/subtle"
 	"errors"
 	"io"
 	"net"
 	"sync"
 )
 
+var zeroAddr = Addr{atyp: AtypIPV4, addr: "0.0.0.0"}
+
 type Server struct {
 	mutex    sync.RWMutex
 	closed   bool
 	listener net.Listener
+	config   ServerConfig
+}
+
+type ServerConfig struct {
+	// if not empty, clients are required to authenticate with username/password
+	Users map[string]string
 }
 
+// the server does not require authentication
 func NewServer() *Server {
+	return NewServerWithConfig(ServerConfig{})
+}
+
+func NewServerWithConfig(config ServerConfig) *Server {
 	s := new(Server)
 	s.closed = true
+	s.config = config
 	return s
 }
 
@@ -54,60 +69,147 @@ func (s *Server) Closed() bool {
 	return s.closed
 }
 
-func (s *Server) Handle(conn net.Conn) (Addr, error) {
-	if err := s.NegotiateMethods(conn); err != nil {
-		return Addr{}, err
-	}
+type Request struct {
+	Cmd  Command
+	Addr Addr
+	// authenticated username, empty if no authentication was required
+	Username string
+}
 
-	reply, _, addr, err := s.GetRequest(conn)
+// negotiates and reads the client request. replying to it is left to the
+// caller, unless the request is invalid.
+//
+// unlike previous versions, Handle does not reply to valid requests and returns
+// a Request instead of the requested address. callers must call Reply once the
+// outcome of the request is known
+func (s *Server) Handle(conn net.Conn) (Request, error) {
+	method, err := s.NegotiateMethod(conn)
 	if err != nil {
-		return Addr{}, err
+		return Request{}, err
 	}
 
-	bnd, _ := NewAddress(conn.LocalAddr().String())
+	username, err := s.Authenticate(conn, method)
+	if err != nil {
+		return Request{}, err
+	}
 
-	if err := s.Reply(conn, reply, bnd); err != nil {
-		return Addr{}, err
+	reply, cmd, addr, err := s.GetRequest(conn)
+	if err != nil {
+		return Request{}, err
 	}
 
 	if reply != ReplyOK {
-		return Addr{}, reply.Err()
+		s.Reply(conn, reply, zeroAddr)
+		return Request{}, reply.Err()
 	}
 
-	return addr, nil
+	return Request{Cmd: cmd, Addr: addr, Username: username}, nil
 }
 
+// kept for compatibility, see NegotiateMethod
 func (s *Server) NegotiateMethods(rw io.ReadWriter) error {
+	_, err := s.NegotiateMethod(rw)
+	return err
+}
+
+// selects the authentication method, username/password if ServerConfig.Users
+// is set and no authentication otherwise. the method must then be passed to
+// Authenticate
+func (s *Server) NegotiateMethod(rw io.ReadWriter) (Method, error) {
 	buf := make([]byte, 2+255)
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return err
+		return MethodNotAcceptable, err
 	}
 
 	if buf[0] != Version {
-		return errors.New("unknown method version")
+		return MethodNotAcceptable, errors.New("unknown method version")
 	}
 
 	nmethods := int(buf[1])
 	if nmethods == 0 {
-		return errors.New("no methods")
+		return MethodNotAcceptable, errors.New("no methods")
 	}
 
 	methods := make([]Method, nmethods)
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return err
+		return MethodNotAcceptable, err
 	}
 	for i, b := range buf[:nmethods] {
 		methods[i] = Method(b)
 	}
 
-	if !hasMethod(methods, MethodNoAuth) {
-		return errors.New("no supported methods")
+	method := MethodNoAuth
+	if len(s.config.Users) != 0 {
+		method = MethodUserPass
 	}
+
+	if !hasMethod(methods, method) {
+		rw.Write([]byte{Version, byte(MethodNotAcceptable)})
+		return MethodNotAcceptable, errors.New("no supported methods")
+	}
+
 	buf = buf[:0]
 	buf = append(buf, Version)
-	buf = append(buf, byte(MethodNoAuth))
+	buf = append(buf, byte(method))
 	_, err := rw.Write(buf)
-	return err
+	return method, err
+}
+
+// returns the authenticated username
+func (s *Server) Authenticate(rw io.ReadWriter, method Method) (string, error) {
+	switch method {
+	case MethodNoAuth:
+		return "", nil
+	case MethodUserPass:
+		return s.userPassAuth(rw)
+	default:
+		return "", errors.New("unsupported method")
+	}
+}
+
+func (s *Server) userPassAuth(rw io.ReadWriter) (string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+
+	if buf[0] != VersionUserPass {
+		return "", errors.New("unknown username/password version")
+	}
+
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen]); err != nil {
+		return "", err
+	}
+	username := string(buf[:ulen])
+
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return "", err
+	}
+	plen := int(buf[0])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return "", err
+	}
+	password := string(buf[:plen])
+
+	if !s.checkUser(username, password) {
+		rw.Write([]byte{VersionUserPass, 0x01})
+		return "", errors.New("invalid username/password")
+	}
+
+	if _, err := rw.Write([]byte{VersionUserPass, 0x00}); err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+func (s *Server) checkUser(username, password string) bool {
+	expected, ok := s.config.Users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
 }
 
 func (s *Server) GetRequest(rw io.ReadWriter) (Reply, Command, Addr, error) {
@@ -123,7 +225,9 @@ func (s *Server) GetRequest(rw io.ReadWriter) (Reply, Command, Addr, error) {
 	}
 
 	cmd := Command(buf[1])
-	if cmd != CmdConnect {
+	switch cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
 		return ReplyCmdNotSupported, cmd, Addr{}, nil
 	}
 
@@ -147,6 +251,105 @@ func (s *Server) Reply(rw io.ReadWriter, reply Reply, address Addr) error {
 	return nil
 }
 
+// replies to an udp associate request and relays datagrams between the
+// client and upstream until conn is closed
+func (s *Server) UDPAssociate(conn net.Conn, upstream net.PacketConn) error {
+	defer upstream.Close()
+
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		s.Reply(conn, ReplyCmdNotSupported, zeroAddr)
+		return errors.New("udp associate requires a tcp listener")
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		s.Reply(conn, ReplyGeneralFailure, zeroAddr)
+		return err
+	}
+	defer relay.Close()
+
+	bnd, err := NewAddress(relay.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+
+	if err := s.Reply(conn, ReplyOK, bnd); err != nil {
+		return err
+	}
+
+	client := conn.RemoteAddr().(*net.TCPAddr)
+
+	var (
+		mutex sync.Mutex
+		// source of the first datagram received from the client
+		peer *net.UDPAddr
+	)
+
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if !from.IP.Equal(client.IP) {
+				continue
+			}
+
+			mutex.Lock()
+			if peer == nil {
+				peer = from
+			}
+			ok := peer.String() == from.String()
+			mutex.Unlock()
+
+			if !ok {
+				continue
+			}
+
+			addr, data, err := ParseDatagram(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			upstream.WriteTo(data, &addr)
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, from, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			addr, err := NewAddress(from.String())
+			if err != nil {
+				continue
+			}
+
+			mutex.Lock()
+			to := peer
+			mutex.Unlock()
+
+			if to == nil {
+				continue
+			}
+
+			relay.WriteToUDP(NewDatagram(addr, buf[:n]), to)
+		}
+	}()
+
+	_, err = io.Copy(io.Discard, conn)
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
 func hasMethod(methods []Method, method Method) bool {
 	for _, m := range methods {
 		if m == method {
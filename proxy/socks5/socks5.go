@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	CmdConnect Command = 0x01
+	CmdConnect      Command = 0x01
+	CmdBind         Command = 0x02
+	CmdUDPAssociate Command = 0x03
 
 	AtypIPV4       AddressType = 0x01
 	AtypDomainName AddressType = 0x03
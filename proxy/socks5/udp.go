@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// max size of a udp datagram payload
+const maxUDPSize = 65535
+
+// returns the destination/source address and the payload of a udp datagram
+func ParseDatagram(b []byte) (Addr, []byte, error) {
+	if len(b) < 4 {
+		return Addr{}, nil, errors.New("datagram is too short")
+	}
+
+	if b[0] != 0 || b[1] != 0 {
+		return Addr{}, nil, errors.New("invalid rsv")
+	}
+
+	if b[2] != 0 {
+		return Addr{}, nil, errors.New("fragmentation is not supported")
+	}
+
+	r := bytes.NewReader(b[3:])
+	addr, err := ReadAddress(r)
+	if err != nil {
+		return Addr{}, nil, err
+	}
+
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// returns a udp datagram containing data addressed to/from addr
+func NewDatagram(addr Addr, data []byte) []byte {
+	buf := make([]byte, 3, 3+1+255+2+len(data))
+	buf = append(buf, addr.Bytes()...)
+	buf = append(buf, data...)
+	return buf
+}
+
+type PacketConn struct {
+	net.PacketConn
+	// control connection, the association ends when it is closed
+	ctrl  net.Conn
+	relay net.Addr
+	once  sync.Once
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if from.String() != c.relay.String() {
+			continue
+		}
+
+		addr, data, err := ParseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		return copy(b, data), &addr, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, err := NewAddress(addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.PacketConn.WriteTo(NewDatagram(a, b), c.relay); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+// closes c once the control connection is closed by the peer
+func (c *PacketConn) watch() {
+	io.Copy(io.Discard, c.ctrl)
+	c.Close()
+}
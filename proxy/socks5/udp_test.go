@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	for _, address := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:8080"} {
+		addr, err := NewAddress(address)
+		if err != nil {
+			t.Fatalf("NewAddress(%q): %s", address, err)
+		}
+
+		b := NewDatagram(addr, []byte("data"))
+
+		got, data, err := ParseDatagram(b)
+		if err != nil {
+			t.Errorf("ParseDatagram(NewDatagram(%q)): %s", address, err)
+			continue
+		}
+		if got.String() != address || string(data) != "data" {
+			t.Errorf("ParseDatagram(NewDatagram(%q)) = %q, %q", address, got.String(), data)
+		}
+	}
+}
+
+func TestNewDatagramBytes(t *testing.T) {
+	addr, err := NewAddress("1.2.3.4:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0, 0, 0, byte(AtypIPV4), 1, 2, 3, 4, 0, 53, 'h', 'i'}
+	if got := NewDatagram(addr, []byte("hi")); !bytes.Equal(got, want) {
+		t.Errorf("NewDatagram = %v, want %v", got, want)
+	}
+}
+
+func TestParseDatagramErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"short":         {0, 0, 0},
+		"rsv":           {0, 1, 0, byte(AtypIPV4), 1, 2, 3, 4, 0, 53},
+		"fragmented":    {0, 0, 1, byte(AtypIPV4), 1, 2, 3, 4, 0, 53},
+		"truncated":     {0, 0, 0, byte(AtypIPV4), 1, 2},
+		"unknown atyp":  {0, 0, 0, 0xff, 1, 2, 3, 4, 0, 53},
+		"domain length": {0, 0, 0, byte(AtypDomainName), 10, 'a', 'b'},
+	}
+
+	for name, b := range tests {
+		if _, _, err := ParseDatagram(b); err == nil {
+			t.Errorf("%s: ParseDatagram(%v) succeeded, want error", name, b)
+		}
+	}
+}
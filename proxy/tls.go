@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// returns nil if TLS is not enabled for proxy
+func tlsConfig(proxy ProxyDialer) (*tls.Config, error) {
+	kwargs := proxy.KWArgs()
+
+	enabled, err := parseBool(kwargs["TLS"])
+	if err != nil {
+		return nil, fmt.Errorf("TLS: %w", err)
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if name, ok := kwargs["TLSServerName"]; ok {
+		config.ServerName = name
+	} else {
+		host, _, err := net.SplitHostPort(proxy.String())
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	if config.InsecureSkipVerify, err = parseBool(kwargs["TLSInsecure"]); err != nil {
+		return nil, fmt.Errorf("TLSInsecure: %w", err)
+	}
+
+	if file, ok := kwargs["TLSCAFile"]; ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("TLSCAFile: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("TLSCAFile: no certificates found in %s", file)
+		}
+	}
+
+	return config, nil
+}
+
+// empty string is false
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "off", "no":
+		return false, nil
+	case "on", "yes":
+		return true, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.New("expected on/off")
+	}
+
+	return b, nil
+}
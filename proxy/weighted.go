@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// smooth weighted round-robin, chains with weight 3 and 1 are picked in
+// the order a a b a instead of a a a b
+type WeightedRoundRobin struct {
+	mutex  sync.RWMutex
+	chains []Chain
+	// current weight of each chain
+	current []int
+	Monitor *Monitor
+}
+
+type WeightedRandom struct {
+	mutex   sync.RWMutex
+	chains  []Chain
+	Monitor *Monitor
+}
+
+func weight(c Chain) int {
+	w, err := c.Weight()
+	if err != nil {
+		return 1
+	}
+	return w
+}
+
+func (w *WeightedRoundRobin) Add(c Chain) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.chains = append(w.chains, c)
+	w.current = append(w.current, 0)
+}
+
+// skips unhealthy chains unless every chain is unhealthy
+func (w *WeightedRoundRobin) Next(s *Session) Chain {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	healthy := false
+	for _, c := range w.chains {
+		if !s.skips(c) && w.Monitor.Healthy(c) {
+			healthy = true
+			break
+		}
+	}
+
+	best := -1
+	total := 0
+	for i, c := range w.chains {
+		if s.skips(c) || healthy && !w.Monitor.Healthy(c) {
+			continue
+		}
+		weight := weight(c)
+		w.current[i] += weight
+		total += weight
+		if best == -1 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	w.current[best] -= total
+	return w.chains[best]
+}
+
+func (w *WeightedRoundRobin) Replace(chains []Chain) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.chains = append([]Chain{}, chains...)
+	w.current = make([]int, len(chains))
+}
+
+func (w *WeightedRoundRobin) Len() int {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return len(w.chains)
+}
+
+func (w *WeightedRoundRobin) All() []Chain {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(w.chains))
+	tmp = append(tmp, w.chains...)
+	return tmp
+}
+
+func (w *WeightedRandom) Add(c Chain) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.chains = append(w.chains, c)
+}
+
+// skips unhealthy chains unless every chain is unhealthy
+func (w *WeightedRandom) Next(s *Session) Chain {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	chains := w.Monitor.Available(w.chains, s)
+	if len(chains) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, c := range chains {
+		total += weight(c)
+	}
+
+	n := rand.Intn(total)
+	for _, c := range chains {
+		n -= weight(c)
+		if n < 0 {
+			return c
+		}
+	}
+
+	return chains[len(chains)-1]
+}
+
+func (w *WeightedRandom) Replace(chains []Chain) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.chains = append([]Chain{}, chains...)
+}
+
+func (w *WeightedRandom) Len() int {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return len(w.chains)
+}
+
+func (w *WeightedRandom) All() []Chain {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	tmp := make([]Chain, 0, len(w.chains))
+	tmp = append(tmp, w.chains...)
+	return tmp
+}